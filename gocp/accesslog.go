@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// access log formats
+const (
+	accessLogJSON     = "json"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+	accessLogTemplate = "template"
+)
+
+// clfTime is the Common Log Format timestamp layout
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessEntry is an access log record, custom templates are executed with it
+type AccessEntry struct {
+	Time      time.Time     `json:"time"`
+	ClientIP  string        `json:"client_ip"`
+	Method    string        `json:"method"`
+	URI       string        `json:"uri"`
+	Proto     string        `json:"proto"`
+	Host      string        `json:"host"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	Service   string        `json:"service,omitempty"`
+	Upstream  string        `json:"upstream,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+	TraceID   string        `json:"trace_id,omitempty"`
+}
+
+type statusRange struct {
+	from, to int
+}
+
+// AccessLog writes the proxied requests log, services can be sampled
+// and filtered by status, the * service holds the default rules
+type AccessLog struct {
+	Format   string
+	template *template.Template
+	rates    map[string]float64
+	statuses map[string][]statusRange
+	out      io.Writer
+	mutex    sync.Mutex
+	stopChan chan struct{}
+}
+
+// NewAccessLog creates the access log from config, it returns nil when the access log is disabled
+func NewAccessLog(config *Config) (*AccessLog, error) {
+	if config.AccessLog == "" {
+		return nil, nil
+	}
+	a := &AccessLog{
+		Format:   config.AccessLogFormat,
+		rates:    make(map[string]float64),
+		statuses: make(map[string][]statusRange),
+		stopChan: make(chan struct{}),
+	}
+	switch a.Format {
+	case accessLogJSON, accessLogCommon, accessLogCombined:
+	case accessLogTemplate:
+		t, err := template.New("access").Parse(config.AccessLogTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("AccessLogTemplate is invalid: %v", err)
+		}
+		a.template = t
+	default:
+		return nil, fmt.Errorf("unknown access log format %s", a.Format)
+	}
+	if err := a.parseRules(config.AccessLogSampling, config.AccessLogStatus); err != nil {
+		return nil, err
+	}
+
+	if config.AccessLog == "stdout" {
+		a.out = os.Stdout
+		return a, nil
+	}
+	out, err := newRotatingFile(config.AccessLog, int64(config.AccessLogMaxSize)*1024*1024,
+		time.Duration(config.AccessLogRotateInterval)*time.Hour, config.AccessLogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	a.out = out
+	return a, nil
+}
+
+// parseRules reads the service=rate sampling list and the service=status filter list,
+// statuses are classes like 5xx, codes or ranges like 400-499 joined with +
+func (a *AccessLog) parseRules(sampling string, status string) error {
+	if err := parseServiceRules(sampling, func(service string, value string) error {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("access log sampling of %s must be between 0 and 1", service)
+		}
+		a.rates[service] = rate
+		return nil
+	}); err != nil {
+		return err
+	}
+	return parseServiceRules(status, func(service string, value string) error {
+		statuses, err := parseStatusRanges(value)
+		if err != nil {
+			return fmt.Errorf("access log status of %s: %v", service, err)
+		}
+		a.statuses[service] = statuses
+		return nil
+	})
+}
+
+// parseServiceRules calls apply for each service=value entry of a comma separated list
+func parseServiceRules(list string, apply func(service string, value string) error) error {
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid access log rule %s, expected service=value", entry)
+		}
+		if err := apply(parts[0], parts[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseStatusRanges parses 5xx+404+300-399
+func parseStatusRanges(value string) ([]statusRange, error) {
+	var ranges []statusRange
+	for _, part := range strings.Split(value, "+") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		switch {
+		case len(part) == 3 && strings.HasSuffix(part, "xx") && part[0] >= '1' && part[0] <= '5':
+			from := int(part[0]-'0') * 100
+			ranges = append(ranges, statusRange{from, from + 99})
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			from, err1 := strconv.Atoi(bounds[0])
+			to, err2 := strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || from > to {
+				return nil, fmt.Errorf("invalid status range %s", part)
+			}
+			ranges = append(ranges, statusRange{from, to})
+		default:
+			code, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid status %s", part)
+			}
+			ranges = append(ranges, statusRange{code, code})
+		}
+	}
+	return ranges, nil
+}
+
+// Log writes the entry if it passes the service status filter and sampling
+func (a *AccessLog) Log(entry *AccessEntry) {
+	if a == nil {
+		return
+	}
+	statuses, ok := a.statuses[entry.Service]
+	if !ok {
+		statuses = a.statuses["*"]
+	}
+	if len(statuses) > 0 {
+		matched := false
+		for _, r := range statuses {
+			if entry.Status >= r.from && entry.Status <= r.to {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+	rate, ok := a.rates[entry.Service]
+	if !ok {
+		rate, ok = a.rates["*"]
+	}
+	if ok && rand.Float64() >= rate {
+		return
+	}
+
+	var line bytes.Buffer
+	switch a.Format {
+	case accessLogJSON:
+		record := struct {
+			*AccessEntry
+			DurationMs float64 `json:"duration_ms"`
+		}{entry, float64(entry.Duration) / float64(time.Millisecond)}
+		json.NewEncoder(&line).Encode(record)
+	case accessLogTemplate:
+		if err := a.template.Execute(&line, entry); err != nil {
+			log.Errorf("Access log template error %s", err.Error())
+			return
+		}
+		line.WriteByte('\n')
+	default:
+		size := "-"
+		if entry.Bytes > 0 {
+			size = strconv.FormatInt(entry.Bytes, 10)
+		}
+		fmt.Fprintf(&line, "%s - - [%s] \"%s %s %s\" %d %s", entry.ClientIP, entry.Time.Format(clfTime),
+			entry.Method, entry.URI, entry.Proto, entry.Status, size)
+		if a.Format == accessLogCombined {
+			fmt.Fprintf(&line, " %q %q", dashIfEmpty(entry.Referer), dashIfEmpty(entry.UserAgent))
+		}
+		line.WriteByte('\n')
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.out.Write(line.Bytes()); err != nil {
+		log.Errorf("Access log write error %s", err.Error())
+	}
+}
+
+// Start waits for the shutdown to close the log file
+func (a *AccessLog) Start() {
+	<-a.stopChan
+}
+
+// Stop closes the log file, the proxy is stopped first so the drained requests are logged
+func (a *AccessLog) Stop() {
+	close(a.stopChan)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if c, ok := a.out.(io.Closer); ok && a.out != os.Stdout {
+		c.Close()
+	}
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// clientIP returns the host part of the request remote address
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// rotatingFile is a log file rotated when it exceeds a size or an age,
+// rotated files are suffixed with their rotation time and the oldest are removed
+type rotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{Path: path, MaxSize: maxSize, MaxAge: maxAge, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Write rotates the file before the write when it is too large or too old,
+// the caller serializes the writes
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if (f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize) || (f.MaxAge > 0 && time.Since(f.opened) > f.MaxAge) {
+		if err := f.rotate(); err != nil {
+			log.Errorf("Access log rotation error %s", err.Error())
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file and opens a new one at the path, the current handle
+// is kept until the new file is open so a failed rotation keeps the log writable
+func (f *rotatingFile) rotate() error {
+	current := f.file
+	backup := f.Path + "." + time.Now().Format("20060102-150405.000")
+	renameErr := os.Rename(f.Path, backup)
+	if err := f.open(); err != nil {
+		// keep appending to the current file, moved back to its path
+		if renameErr == nil {
+			os.Rename(backup, f.Path)
+		}
+		return err
+	}
+	current.Close()
+	if renameErr != nil {
+		// keep appending to the file at the path
+		return renameErr
+	}
+	if f.MaxBackups > 0 {
+		backups, _ := filepath.Glob(f.Path + ".*")
+		sort.Strings(backups)
+		for len(backups) > f.MaxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// Close closes the current file
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
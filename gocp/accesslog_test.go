@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAccessEntry is a proxied request of the echo service
+func testAccessEntry() *AccessEntry {
+	return &AccessEntry{
+		Time:      time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC),
+		ClientIP:  "10.0.0.1",
+		Method:    "GET",
+		URI:       "/echo/a?b=c",
+		Proto:     "HTTP/1.1",
+		Host:      "proxy.local",
+		Status:    200,
+		Bytes:     42,
+		Duration:  1500 * time.Microsecond,
+		UserAgent: "curl/8.0",
+		Service:   "echo",
+		RequestID: "req-1",
+	}
+}
+
+// testAccessLog creates an access log to a file in a temp dir
+func testAccessLog(t *testing.T, config *Config) (*AccessLog, string) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	config.AccessLog = path
+	if config.AccessLogFormat == "" {
+		config.AccessLogFormat = accessLogJSON
+	}
+	a, err := NewAccessLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, path
+}
+
+// readLines stops the access log and returns the lines of the file
+func readLines(t *testing.T, a *AccessLog, path string) []string {
+	a.Stop()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	tests := []struct {
+		format   string
+		template string
+		line     string
+	}{
+		{format: accessLogCommon, line: `10.0.0.1 - - [02/Jan/2026:15:04:05 +0000] "GET /echo/a?b=c HTTP/1.1" 200 42`},
+		{format: accessLogCombined, line: `10.0.0.1 - - [02/Jan/2026:15:04:05 +0000] "GET /echo/a?b=c HTTP/1.1" 200 42 "-" "curl/8.0"`},
+		{format: accessLogTemplate, template: "{{.Method}} {{.URI}} {{.Status}} {{.Duration}} {{.RequestID}}", line: "GET /echo/a?b=c 200 1.5ms req-1"},
+	}
+	for _, tt := range tests {
+		a, path := testAccessLog(t, &Config{AccessLogFormat: tt.format, AccessLogTemplate: tt.template})
+		a.Log(testAccessEntry())
+		if lines := readLines(t, a, path); len(lines) != 1 || lines[0] != tt.line {
+			t.Errorf("%s lines %q, want %q", tt.format, lines, tt.line)
+		}
+	}
+
+	a, path := testAccessLog(t, &Config{AccessLogFormat: accessLogJSON})
+	a.Log(testAccessEntry())
+	lines := readLines(t, a, path)
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"client_ip": "10.0.0.1", "uri": "/echo/a?b=c", "status": 200.0, "bytes": 42.0,
+		"duration_ms": 1.5, "service": "echo", "request_id": "req-1", "time": "2026-01-02T15:04:05Z"}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("json %s = %v, want %v", key, record[key], value)
+		}
+	}
+	for _, key := range []string{"referer", "upstream", "trace_id", "Duration"} {
+		if _, ok := record[key]; ok {
+			t.Errorf("json has %s", key)
+		}
+	}
+}
+
+func TestNewAccessLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		err    string
+	}{
+		{name: "unknown format", config: Config{AccessLogFormat: "xml"}, err: "unknown access log format"},
+		{name: "invalid template", config: Config{AccessLogFormat: accessLogTemplate, AccessLogTemplate: "{{.Method"}, err: "AccessLogTemplate"},
+		{name: "sampling above 1", config: Config{AccessLogSampling: "echo=2"}, err: "between 0 and 1"},
+		{name: "sampling without service", config: Config{AccessLogSampling: "=0.5"}, err: "service=value"},
+		{name: "invalid status", config: Config{AccessLogStatus: "echo=6xx"}, err: "invalid status"},
+		{name: "inverted range", config: Config{AccessLogStatus: "echo=499-400"}, err: "invalid status range"},
+	}
+	for _, tt := range tests {
+		config := tt.config
+		config.AccessLog = filepath.Join(t.TempDir(), "access.log")
+		if config.AccessLogFormat == "" {
+			config.AccessLogFormat = accessLogJSON
+		}
+		if _, err := NewAccessLog(&config); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	if a, err := NewAccessLog(&Config{}); a != nil || err != nil {
+		t.Errorf("disabled access log %v %v", a, err)
+	}
+}
+
+func TestAccessLogFilters(t *testing.T) {
+	tests := []struct {
+		name     string
+		sampling string
+		status   string
+		service  string
+		statuses []int
+		logged   int
+	}{
+		{name: "no rules", service: "echo", statuses: []int{200, 404, 502}, logged: 3},
+		{name: "service class", status: "echo=5xx", service: "echo", statuses: []int{200, 404, 500, 599}, logged: 2},
+		{name: "codes and ranges", status: "echo=404+300-399", service: "echo", statuses: []int{200, 301, 399, 404, 500}, logged: 3},
+		{name: "default rule", status: "*=4xx+5xx", service: "echo", statuses: []int{200, 404, 500}, logged: 2},
+		{name: "service rule over default", status: "echo=2xx,*=5xx", service: "echo", statuses: []int{200, 500}, logged: 1},
+		{name: "other service uses default", status: "echo=2xx,*=5xx", service: "other", statuses: []int{200, 500}, logged: 1},
+		{name: "sampled out", sampling: "echo=0", service: "echo", statuses: []int{200, 500}, logged: 0},
+		{name: "sampled in", sampling: "echo=1,*=0", service: "echo", statuses: []int{200, 500}, logged: 2},
+		{name: "default sampling", sampling: "echo=1,*=0", service: "other", statuses: []int{200, 500}, logged: 0},
+		{name: "status before sampling", sampling: "echo=1", status: "echo=5xx", service: "echo", statuses: []int{200, 500}, logged: 1},
+	}
+	for _, tt := range tests {
+		a, path := testAccessLog(t, &Config{AccessLogSampling: tt.sampling, AccessLogStatus: tt.status})
+		for _, status := range tt.statuses {
+			entry := testAccessEntry()
+			entry.Service, entry.Status = tt.service, status
+			a.Log(entry)
+		}
+		logged := 0
+		for _, line := range readLines(t, a, path) {
+			if line != "" {
+				logged++
+			}
+		}
+		if logged != tt.logged {
+			t.Errorf("%s: %v lines logged, want %v", tt.name, logged, tt.logged)
+		}
+	}
+
+	// a rate between 0 and 1 logs a share of the requests
+	a, path := testAccessLog(t, &Config{AccessLogSampling: "*=0.5"})
+	for i := 0; i < 1000; i++ {
+		a.Log(testAccessEntry())
+	}
+	if logged := len(readLines(t, a, path)); logged < 350 || logged > 650 {
+		t.Errorf("%v of 1000 lines logged at a 0.5 rate", logged)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := newRotatingFile(path, 20, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"first line\n", "second line\n", "third line\n", "fourth line\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		// backups are named by the rotation time in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "fourth line\n" {
+		t.Errorf("current file %q, want the last line", data)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("%v backups, want 2", backups)
+	}
+	for i, want := range []string{"second line\n", "third line\n"} {
+		if data, _ := ioutil.ReadFile(backups[i]); string(data) != want {
+			t.Errorf("backup %s %q, want %q", backups[i], data, want)
+		}
+	}
+
+	// a line larger than the max size is written to the empty file
+	if _, err := f.Write([]byte(strings.Repeat("x", 30) + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("next\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "next\n" {
+		t.Errorf("current file %q after a large line", data)
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := newRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("old\n"))
+	f.opened = time.Now().Add(-2 * time.Hour)
+	f.Write([]byte("new\n"))
+	if data, _ := ioutil.ReadFile(path); string(data) != "new\n" {
+		t.Errorf("current file %q, want the line after the rotation", data)
+	}
+	if backups, _ := filepath.Glob(path + ".*"); len(backups) != 1 {
+		t.Errorf("%v backups, want 1", backups)
+	}
+}
+
+func TestRotatingFileRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := newRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("first line\n"))
+
+	// the rename fails once the file is removed, the log goes on at the path
+	os.Remove(path)
+	if err := f.rotate(); err == nil {
+		t.Error("expected the rename error")
+	}
+	if _, err := f.Write([]byte("second line\n")); err != nil {
+		t.Fatalf("write after a failed rotation: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(path); !strings.HasSuffix(string(data), "second line\n") {
+		t.Errorf("current file %q, want the line after the failed rotation", data)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul_api "github.com/hashicorp/consul/api"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Alias maps a service name used by callers to the service that serves it,
+// either transparently or by redirecting the caller to the new name
+type Alias struct {
+	Service    string `yaml:"service"`
+	Redirect   int    `yaml:"redirect"`
+	Deprecated bool   `yaml:"deprecated"`
+	Sunset     string `yaml:"sunset"`
+	sunset     time.Time
+}
+
+// aliasFile is the alias table format, stored in a file or a Consul KV key:
+//
+//	aliases:
+//	  billing-old:
+//	    service: billing
+//	    redirect: 308
+//	    deprecated: true
+//	    sunset: 2027-01-01T00:00:00Z
+type aliasFile struct {
+	Aliases map[string]*Alias `yaml:"aliases"`
+}
+
+// AliasTable holds the aliases loaded from a file or a Consul KV key,
+// the table is replaced as a whole on each change and read without locks
+type AliasTable struct {
+	// CallerHeader identifies the caller of an alias, only the Callers are labeled in metrics
+	CallerHeader string
+	Callers      []string
+	aliases      atomic.Value
+	source       *watchedSource
+}
+
+// NewAliasTable creates the alias table, it returns nil when no alias source is configured
+func NewAliasTable(config *Config, client *consul_api.Client) (*AliasTable, error) {
+	if config.AliasFile == "" && config.AliasKVKey == "" {
+		return nil, nil
+	}
+	if config.AliasFile != "" && config.AliasKVKey != "" {
+		return nil, fmt.Errorf("AliasFile and AliasKVKey are mutually exclusive")
+	}
+	t := &AliasTable{CallerHeader: config.AliasCallerHeader}
+	for _, caller := range strings.Split(config.AliasCallers, ",") {
+		if caller = strings.TrimSpace(caller); caller != "" {
+			t.Callers = append(t.Callers, caller)
+		}
+	}
+	t.aliases.Store(make(map[string]*Alias))
+	t.source = newWatchedSource(config.AliasFile, config.AliasFileInterval, config.AliasKVKey, client, t.apply)
+	return t, nil
+}
+
+// Lookup returns the alias of a service name
+func (t *AliasTable) Lookup(name string) (*Alias, bool) {
+	if t == nil {
+		return nil, false
+	}
+	alias, ok := t.aliases.Load().(map[string]*Alias)[name]
+	return alias, ok
+}
+
+// Caller returns the caller label of a request addressed to an alias, the known callers
+// match the header value or its first product token, e.g. billing for billing/1.2,
+// the other values are labeled other to bound the metrics cardinality
+func (t *AliasTable) Caller(req *http.Request) string {
+	if t.CallerHeader == "" {
+		return "unknown"
+	}
+	value := req.Header.Get(t.CallerHeader)
+	if value == "" {
+		return "unknown"
+	}
+	for _, caller := range t.Callers {
+		if value == caller || strings.HasPrefix(value, caller+"/") {
+			return caller
+		}
+	}
+	return "other"
+}
+
+// Start loads the alias table and watches its source for changes
+func (t *AliasTable) Start() {
+	t.source.Start()
+}
+
+// Stop ends the alias source watch
+func (t *AliasTable) Stop() {
+	t.source.Stop()
+}
+
+// apply replaces the alias table, an invalid table is ignored and the last good one is kept
+func (t *AliasTable) apply(source string, data []byte) {
+	aliases, err := parseAliases(data)
+	if err != nil {
+		log.Errorf("Alias table from %s is invalid, keeping the last table: %s", source, err.Error())
+		return
+	}
+	t.aliases.Store(aliases)
+	log.Infof("Alias table loaded from %s with %v aliases", source, len(aliases))
+}
+
+// parseAliases parses and validates a YAML or JSON alias table
+func parseAliases(data []byte) (map[string]*Alias, error) {
+	var file aliasFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	aliases := make(map[string]*Alias, len(file.Aliases))
+	for name, alias := range file.Aliases {
+		if alias == nil || alias.Service == "" {
+			return nil, fmt.Errorf("alias %s has no service", name)
+		}
+		if alias.Service == name {
+			return nil, fmt.Errorf("alias %s points to itself", name)
+		}
+		if _, ok := file.Aliases[alias.Service]; ok {
+			return nil, fmt.Errorf("alias %s points to the alias %s", name, alias.Service)
+		}
+		switch alias.Redirect {
+		case 0, http.StatusMovedPermanently, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("alias %s redirect must be %v or %v", name, http.StatusMovedPermanently, http.StatusPermanentRedirect)
+		}
+		if alias.Sunset != "" {
+			sunset, err := time.Parse(time.RFC3339, alias.Sunset)
+			if err != nil {
+				return nil, fmt.Errorf("alias %s sunset is not a RFC3339 date: %v", name, err)
+			}
+			alias.sunset = sunset
+		}
+		aliases[name] = alias
+	}
+	return aliases, nil
+}
+
+// SetHeaders adds the deprecation headers of the alias to the response
+func (a *Alias) SetHeaders(h http.Header) {
+	if !a.Deprecated {
+		return
+	}
+	h.Set("Deprecation", "true")
+	if !a.sunset.IsZero() {
+		h.Set("Sunset", a.sunset.UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAliasCaller(t *testing.T) {
+	table, err := NewAliasTable(&Config{AliasFile: "aliases.yaml", AliasCallerHeader: "User-Agent", AliasCallers: "billing, web"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		agent string
+		want  string
+	}{
+		{agent: "billing", want: "billing"},
+		{agent: "web/2.1 (linux)", want: "web"},
+		{agent: "webhook/1.0", want: "other"},
+		{agent: "curl/8.0", want: "other"},
+		{agent: "", want: "unknown"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", tt.agent)
+		if got := table.Caller(req); got != tt.want {
+			t.Errorf("caller of %q is %s, want %s", tt.agent, got, tt.want)
+		}
+	}
+}
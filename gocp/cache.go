@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RegistryCache writes the registry to disk after each change
+// so goc-proxy can route on cold starts while Consul is unreachable
+type RegistryCache struct {
+	Path     string
+	Registry *Registry
+	stopChan chan struct{}
+}
+
+// NewRegistryCache creates the registry disk writer
+func NewRegistryCache(path string, registry *Registry) *RegistryCache {
+	return &RegistryCache{
+		Path:     path,
+		Registry: registry,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Load adds the cached registry as the lowest precedence routes,
+// they are marked as stale until every provider has synced
+func (c *RegistryCache) Load() error {
+	data, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	var snapshot RegistrySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if sha := makeSHA(snapshot.Catalog, snapshot.Sources); sha != snapshot.Sha {
+		return fmt.Errorf("registry cache %s is corrupted, sha mismatch", c.Path)
+	}
+	c.Registry.Update(providerCache, snapshot.Catalog)
+	log.Infof("Registry loaded from %s with %v services, routes are stale until the first sync", c.Path, len(snapshot.Catalog))
+	return nil
+}
+
+// Start writes the registry on each update, the providers can sync before the
+// writer subscribes so the current registry is written first
+func (c *RegistryCache) Start() {
+	updates := c.Registry.Subscribe()
+	defer c.Registry.Unsubscribe(updates)
+	c.persist(c.Registry.Snapshot())
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case snapshot := <-updates:
+			c.persist(snapshot)
+		}
+	}
+}
+
+func (c *RegistryCache) persist(snapshot *RegistrySnapshot) {
+	// don't persist routes that came from the cache itself or an empty registry
+	if snapshot.Stale || snapshot.Version == 0 {
+		return
+	}
+	if err := c.write(snapshot); err != nil {
+		log.Errorf("Registry cache write error %s", err.Error())
+	}
+}
+
+// Stop ends the registry cache writer
+func (c *RegistryCache) Stop() {
+	close(c.stopChan)
+}
+
+// write replaces the cache file atomically
+func (c *RegistryCache) write(snapshot *RegistrySnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.Path, data, 0600)
+}
+
+// writeFileAtomic replaces the file with a synced temporary file so readers never see a partial write
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistryCacheWritesSyncBeforeStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.json")
+
+	registry := NewRegistry([]string{providerFile})
+	registry.Update(providerFile, map[string][]Endpoint{"alpha": {{Address: "10.0.0.1:80"}}})
+
+	cache := NewRegistryCache(path, registry)
+	done := make(chan struct{})
+	go func() {
+		cache.Start()
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("registry synced before the cache start was not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cache.Stop()
+	<-done
+
+	loaded := NewRegistry([]string{providerFile})
+	if err := NewRegistryCache(path, loaded).Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loaded.Lookup("alpha"); err != nil {
+		t.Error(err)
+	}
+}
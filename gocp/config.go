@@ -1,16 +1,122 @@
 package main
 
+import "net/url"
+
 // Config holds global configuration, defaults are provided in main.
 // GOC-Proxy config is populated from startup flag.
 type Config struct {
-	Node                string
-	Cluster             string
-	Domain              string
-	Environment         string
-	LogLevel            string
-	Port                int
-	ElectionKeyPrefix   string
-	HttpScheme          string
-	MaxIdleConnsPerHost int
-	DisableKeepAlives   bool
+	Node                      string
+	Cluster                   string
+	Domain                    string
+	Environment               string
+	LogLevel                  string
+	Port                      int
+	ElectionKeyPrefix         string
+	ConsulAddress             string
+	ConsulScheme              string
+	ConsulDatacenter          string
+	ConsulToken               string
+	ConsulTokenFile           string
+	ConsulCAFile              string
+	ConsulCertFile            string
+	ConsulKeyFile             string
+	HttpScheme                string
+	UpstreamTLSDir            string
+	MaxIdleConnsPerHost       int
+	DisableKeepAlives         bool
+	IdleConnTimeout           int
+	Connect                   bool
+	ConnectService            string
+	ConnectCallerHeader       string
+	ConnectCallerTrustedCIDRs string
+	ProxyProtocol             bool
+	ProxyProtocolTrustedCIDRs string
+	ResyncInterval            int
+	HealthPolicy              string
+	HealthWarningWeight       int
+	HealthIgnoreChecks        string
+	ExposeMode                string
+	ExposeTag                 string
+	ExposeInclude             string
+	ExposeExclude             string
+	SyncDebounce              int
+	Providers                 string
+	ProviderFile              string
+	ProviderFileInterval      int
+	DNSServices               string
+	DNSResolver               string
+	DNSInterval               int
+	GuardMaxServiceLoss       int
+	GuardMaxEndpointLoss      int
+	GuardSyncs                int
+	GuardHold                 int
+	RegistryCacheFile         string
+	AliasFile                 string
+	AliasFileInterval         int
+	AliasKVKey                string
+	AliasCallerHeader         string
+	AliasCallers              string
+	RouteFile                 string
+	RouteFileInterval         int
+	RouteKVKey                string
+	ErrorTemplates            string
+	WrongHostStatus           int
+	RequestIDHeader           string
+	RequestIDPattern          string
+	TracingExporter           string
+	TracingEndpoint           string
+	TracingServiceName        string
+	TracingSampleRate         float64
+	TracingPropagation        string
+	AccessLog                 string
+	AccessLogFormat           string
+	AccessLogTemplate         string
+	AccessLogMaxSize          int
+	AccessLogRotateInterval   int
+	AccessLogMaxBackups       int
+	AccessLogSampling         string
+	AccessLogStatus           string
+	MetricsLatencyBuckets     string
+	MetricsSizeBuckets        string
+	MetricsMethodLabel        bool
+	MetricsStatusClassLabel   bool
+	MetricsLegacy             bool
+	SDFile                    string
+	SDTag                     string
+	StatsDAddress             string
+	StatsDFlavor              string
+	MetricsOTLPEndpoint       string
+	MetricsPushInterval       int
+	MetricsPushPrefix         string
+	AlertErrorRate            float64
+	AlertWindow               string
+	GenerateFrom              string
+	SLOFile                   string
+	SLOFileInterval           int
+	SLOKVKey                  string
+}
+
+// Redacted returns a copy of the config safe to expose on the admin endpoints,
+// the Consul token and credential file paths are masked along the endpoints user info
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	for _, secret := range []*string{&redacted.ConsulToken, &redacted.ConsulTokenFile, &redacted.ConsulKeyFile} {
+		if *secret != "" {
+			*secret = "redacted"
+		}
+	}
+	for _, endpoint := range []*string{&redacted.ConsulAddress, &redacted.TracingEndpoint, &redacted.MetricsOTLPEndpoint} {
+		*endpoint = redactURL(*endpoint)
+	}
+	return &redacted
+}
+
+// redactURL masks the user info of an URL, it may hold a password or a token
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = url.User("redacted")
+	return u.String()
 }
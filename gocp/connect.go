@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+// ConnectAgent keeps the goc-proxy Connect leaf certificate and CA roots
+// in sync with the local Consul agent and checks intentions
+type ConnectAgent struct {
+	Config       *Config
+	ConsulClient *consul_api.Client
+	ConsulConfig *consul_api.Config
+	// datacenter is the Consul datacenter of the caller identities, set from config or the local agent
+	datacenter  string
+	trustDomain string
+	leaf        *tls.Certificate
+	roots       *x509.CertPool
+	// trustedCallers are the client networks allowed to set the caller header
+	trustedCallers []*net.IPNet
+	decisions      map[string]connectDecision
+	mutex          sync.RWMutex
+	stopChan       chan struct{}
+}
+
+type connectDecision struct {
+	authorized bool
+	expires    time.Time
+}
+
+type connectLeaf struct {
+	SerialNumber  string
+	CertPEM       string
+	PrivateKeyPEM string
+	ServiceURI    string
+}
+
+type connectRoots struct {
+	TrustDomain string
+	Roots       []struct {
+		RootCert          string
+		IntermediateCerts []string
+	}
+}
+
+type connectAuthorizeRequest struct {
+	Target        string
+	ClientCertURI string
+}
+
+type connectAuthorizeResponse struct {
+	Authorized bool
+	Reason     string
+}
+
+// intention decisions are cached to avoid a Consul round trip on every request
+const (
+	connectDecisionTTL  = 10 * time.Second
+	connectDecisionsMax = 1024
+)
+
+// NewConnectAgent creates the Connect certificate manager
+func NewConnectAgent(config *Config, client *consul_api.Client, consulConfig *consul_api.Config) (*ConnectAgent, error) {
+	trusted, err := parseCIDRs(config.ConnectCallerTrustedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("ConnectCallerTrustedCIDRs: %v", err)
+	}
+	datacenter := config.ConsulDatacenter
+	if datacenter == "" && consulConfig != nil {
+		datacenter = consulConfig.Datacenter
+	}
+	return &ConnectAgent{
+		Config:         config,
+		ConsulClient:   client,
+		ConsulConfig:   consulConfig,
+		datacenter:     datacenter,
+		trustedCallers: trusted,
+		decisions:      make(map[string]connectDecision),
+		stopChan:       make(chan struct{}),
+	}, nil
+}
+
+// Start watches the leaf certificate and the CA roots,
+// the datacenter is loaded from the local agent when not configured
+func (c *ConnectAgent) Start() {
+	c.mutex.RLock()
+	datacenter := c.datacenter
+	c.mutex.RUnlock()
+	if datacenter == "" {
+		go c.loadDatacenter()
+	}
+	roots := "/v1/agent/connect/ca/roots"
+	leaf := "/v1/agent/connect/ca/leaf/" + c.Config.ConnectService
+	go watchQuery(c.ConsulClient, roots, c.stopChan, func() interface{} { return &connectRoots{} }, c.handle(roots, c.setRoots), nil)
+	watchQuery(c.ConsulClient, leaf, c.stopChan, func() interface{} { return &connectLeaf{} }, c.handle(leaf, c.setLeaf), nil)
+}
+
+// loadDatacenter queries the local agent datacenter until it succeeds or the agent is stopped,
+// intentions are denied meanwhile
+func (c *ConnectAgent) loadDatacenter() {
+	for failures := 1; ; failures++ {
+		err := c.queryDatacenter()
+		if err == nil {
+			return
+		}
+		retry := watchBackoff(failures)
+		log.Warnf("Connect agent info error %s, retry in %v", err.Error(), retry)
+		select {
+		case <-time.After(retry):
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+func (c *ConnectAgent) queryDatacenter() error {
+	self, err := c.ConsulClient.Agent().Self()
+	if err != nil {
+		return err
+	}
+	dc, ok := self["Config"]["Datacenter"].(string)
+	if !ok || dc == "" {
+		return errors.New("datacenter missing from the agent config")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.datacenter = dc
+	return nil
+}
+
+// Stop ends the certificate watchers
+func (c *ConnectAgent) Stop() {
+	close(c.stopChan)
+}
+
+// applies a Connect endpoint update
+func (c *ConnectAgent) handle(endpoint string, update func(interface{}) error) func(uint64, interface{}) {
+	return func(idx uint64, data interface{}) {
+		if err := update(data); err != nil {
+			log.Errorf("Connect %s update error %s", endpoint, err.Error())
+		}
+	}
+}
+
+func (c *ConnectAgent) setRoots(data interface{}) error {
+	roots := data.(*connectRoots)
+	pool := x509.NewCertPool()
+	for _, root := range roots.Roots {
+		if !pool.AppendCertsFromPEM([]byte(root.RootCert)) {
+			return errors.New("invalid Connect root certificate")
+		}
+		for _, intermediate := range root.IntermediateCerts {
+			pool.AppendCertsFromPEM([]byte(intermediate))
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.roots = pool
+	c.trustDomain = roots.TrustDomain
+	log.Infof("Connect CA roots updated, trust domain %s", roots.TrustDomain)
+	return nil
+}
+
+func (c *ConnectAgent) setLeaf(data interface{}) error {
+	leaf := data.(*connectLeaf)
+	cert, err := tls.X509KeyPair([]byte(leaf.CertPEM), []byte(leaf.PrivateKeyPEM))
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.leaf = &cert
+	log.Infof("Connect leaf certificate updated, serial %s", leaf.SerialNumber)
+	return nil
+}
+
+// TLSConfig returns the mTLS config used to dial the Connect enabled service.
+// Certificates are resolved on each handshake so rotations don't require a new transport.
+func (c *ConnectAgent) TLSConfig(service string) *tls.Config {
+	return &tls.Config{
+		// the server certificate has no DNS SAN, it's verified against the Connect roots and SPIFFE ID
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+			if c.leaf == nil {
+				return nil, errors.New("Connect leaf certificate not loaded")
+			}
+			return c.leaf, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return c.verifyService(service, rawCerts)
+		},
+	}
+}
+
+func (c *ConnectAgent) verifyService(service string, rawCerts [][]byte) error {
+	c.mutex.RLock()
+	roots := c.roots
+	c.mutex.RUnlock()
+	if roots == nil {
+		return errors.New("Connect CA roots not loaded")
+	}
+	if len(rawCerts) == 0 {
+		return errors.New("no peer certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return err
+	}
+	for _, uri := range certs[0].URIs {
+		if uri.Scheme == "spiffe" && strings.HasSuffix(uri.Path, "/svc/"+service) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer certificate is not valid for service %s", service)
+}
+
+// Caller returns the service name checked against the intentions for a request, the
+// ConnectCallerHeader is only accepted from clients in ConnectCallerTrustedCIDRs,
+// other requests are authorized as ConnectService
+func (c *ConnectAgent) Caller(req *http.Request) string {
+	header := c.Config.ConnectCallerHeader
+	if header == "" || req.Header.Get(header) == "" {
+		return c.Config.ConnectService
+	}
+	ip := net.ParseIP(clientIP(req.RemoteAddr))
+	for _, network := range c.trustedCallers {
+		if ip != nil && network.Contains(ip) {
+			return req.Header.Get(header)
+		}
+	}
+	requestLog(req).Debugf("Connect caller header ignored from untrusted client %s", req.RemoteAddr)
+	return c.Config.ConnectService
+}
+
+// Authorize checks the Consul intentions for the caller to service route
+func (c *ConnectAgent) Authorize(caller string, service string) (bool, error) {
+	key := caller + "/" + service
+	c.mutex.RLock()
+	decision, ok := c.decisions[key]
+	trustDomain, datacenter := c.trustDomain, c.datacenter
+	c.mutex.RUnlock()
+	if ok && time.Now().Before(decision.expires) {
+		return decision.authorized, nil
+	}
+	if trustDomain == "" {
+		return false, errors.New("Connect trust domain not loaded")
+	}
+	if datacenter == "" {
+		return false, errors.New("Connect datacenter not loaded")
+	}
+
+	in := connectAuthorizeRequest{
+		Target:        service,
+		ClientCertURI: fmt.Sprintf("spiffe://%s/ns/default/dc/%s/svc/%s", trustDomain, datacenter, caller),
+	}
+	out := connectAuthorizeResponse{}
+	if err := c.post("/v1/agent/connect/authorize", in, &out); err != nil {
+		return false, err
+	}
+	if !out.Authorized {
+		log.Debugf("Connect route %s denied: %s", key, out.Reason)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if len(c.decisions) >= connectDecisionsMax {
+		c.pruneDecisions(now)
+	}
+	c.decisions[key] = connectDecision{
+		authorized: out.Authorized,
+		expires:    now.Add(connectDecisionTTL),
+	}
+	return out.Authorized, nil
+}
+
+// pruneDecisions drops the expired decisions, the cache is emptied if they are all valid.
+// It must be called with the lock held.
+func (c *ConnectAgent) pruneDecisions(now time.Time) {
+	for key, decision := range c.decisions {
+		if !now.Before(decision.expires) {
+			delete(c.decisions, key)
+		}
+	}
+	if len(c.decisions) >= connectDecisionsMax {
+		c.decisions = make(map[string]connectDecision)
+	}
+}
+
+// the authorize endpoint accepts only POST, the Consul client Raw API uses PUT for writes
+func (c *ConnectAgent) post(endpoint string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.ConsulConfig.Scheme+"://"+c.ConsulConfig.Address+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.ConsulConfig.Token != "" {
+		req.Header.Set("X-Consul-Token", c.ConsulConfig.Token)
+	}
+	resp, err := c.ConsulConfig.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Connect authorize unexpected response code: %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// connectEndpoints returns the endpoints reachable in the current Connect mode
+func connectEndpoints(endpoints []Endpoint, enabled bool) []Endpoint {
+	// services registered in a single mode are returned as is, without allocating
+	mixed := false
+	for _, e := range endpoints {
+		if e.Connect != endpoints[0].Connect {
+			mixed = true
+			break
+		}
+	}
+	if !mixed && (len(endpoints) == 0 || !endpoints[0].Connect || enabled) {
+		return endpoints
+	}
+	var connect, plain []Endpoint
+	for _, e := range endpoints {
+		if e.Connect {
+			connect = append(connect, e)
+		} else {
+			plain = append(plain, e)
+		}
+	}
+	if enabled && len(connect) > 0 {
+		return connect
+	}
+	return plain
+}
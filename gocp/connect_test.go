@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+func TestConnectCaller(t *testing.T) {
+	config := &Config{ConnectService: "goc-proxy", ConnectCallerHeader: "X-Caller", ConnectCallerTrustedCIDRs: "10.0.0.0/8"}
+	agent, err := NewConnectAgent(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       string
+	}{
+		{name: "trusted client", remoteAddr: "10.1.2.3:5000", header: "billing", want: "billing"},
+		{name: "untrusted client", remoteAddr: "192.168.1.1:5000", header: "billing", want: "goc-proxy"},
+		{name: "no header", remoteAddr: "10.1.2.3:5000", want: "goc-proxy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("X-Caller", tt.header)
+			}
+			if got := agent.Caller(req); got != tt.want {
+				t.Errorf("caller %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectCallerUntrustedByDefault(t *testing.T) {
+	agent, err := NewConnectAgent(&Config{ConnectService: "goc-proxy", ConnectCallerHeader: "X-Caller"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:5000"
+	req.Header.Set("X-Caller", "billing")
+	if got := agent.Caller(req); got != "goc-proxy" {
+		t.Errorf("caller %s, want goc-proxy", got)
+	}
+}
+
+func TestConnectDecisionsPrune(t *testing.T) {
+	agent, _ := NewConnectAgent(&Config{}, nil, nil)
+	now := time.Now()
+	for i := 0; i < connectDecisionsMax; i++ {
+		expires := now.Add(connectDecisionTTL)
+		if i%2 == 0 {
+			expires = now.Add(-time.Second)
+		}
+		agent.decisions[string(rune(i))] = connectDecision{expires: expires}
+	}
+	agent.pruneDecisions(now)
+	if len(agent.decisions) != connectDecisionsMax/2 {
+		t.Errorf("%v decisions after prune, want %v", len(agent.decisions), connectDecisionsMax/2)
+	}
+	for i := len(agent.decisions); i < connectDecisionsMax; i++ {
+		agent.decisions[string(rune(i+connectDecisionsMax))] = connectDecision{expires: now.Add(connectDecisionTTL)}
+	}
+	agent.pruneDecisions(now)
+	if len(agent.decisions) != 0 {
+		t.Errorf("%v decisions after prune of a full cache, want 0", len(agent.decisions))
+	}
+}
+
+func TestConnectEndpoints(t *testing.T) {
+	plain := Endpoint{Address: "10.0.0.1:80"}
+	connect := Endpoint{Address: "10.0.0.2:21000", Connect: true}
+	tests := []struct {
+		name      string
+		endpoints []Endpoint
+		enabled   bool
+		want      []Endpoint
+	}{
+		{name: "plain", endpoints: []Endpoint{plain}, enabled: true, want: []Endpoint{plain}},
+		{name: "connect", endpoints: []Endpoint{connect}, enabled: true, want: []Endpoint{connect}},
+		{name: "connect disabled", endpoints: []Endpoint{connect}, enabled: false, want: nil},
+		{name: "mixed", endpoints: []Endpoint{plain, connect}, enabled: true, want: []Endpoint{connect}},
+		{name: "mixed disabled", endpoints: []Endpoint{connect, plain}, enabled: false, want: []Endpoint{plain}},
+		{name: "empty", endpoints: nil, enabled: true, want: nil},
+	}
+	for _, tt := range tests {
+		got := connectEndpoints(tt.endpoints, tt.enabled)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Address != tt.want[i].Address {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+// testConnectConsul serves the agent self and authorize endpoints, the agent self fails until the datacenter is set
+type testConnectConsul struct {
+	datacenter string
+	uris       []string
+}
+
+func (c *testConnectConsul) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/v1/agent/self":
+		if c.datacenter == "" {
+			http.Error(w, "agent unavailable", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]map[string]interface{}{"Config": {"Datacenter": c.datacenter}})
+	case "/v1/agent/connect/authorize":
+		var in connectAuthorizeRequest
+		json.NewDecoder(req.Body).Decode(&in)
+		c.uris = append(c.uris, in.ClientCertURI)
+		json.NewEncoder(w).Encode(connectAuthorizeResponse{Authorized: true})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func testConnectAgent(t *testing.T, consul *testConnectConsul, config *Config) *ConnectAgent {
+	server := httptest.NewServer(consul)
+	t.Cleanup(server.Close)
+	consulConfig := consul_api.DefaultConfig()
+	consulConfig.Address = strings.TrimPrefix(server.URL, "http://")
+	client, err := consul_api.NewClient(consulConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent, err := NewConnectAgent(config, client, consulConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.trustDomain = "11111111-2222.consul"
+	return agent
+}
+
+func TestConnectAuthorizeDatacenter(t *testing.T) {
+	consul := &testConnectConsul{}
+	agent := testConnectAgent(t, consul, &Config{ConnectService: "goc-proxy", ConsulDatacenter: "dc1"})
+	if _, err := agent.Authorize("web", "api"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "spiffe://11111111-2222.consul/ns/default/dc/dc1/svc/web"; len(consul.uris) != 1 || consul.uris[0] != want {
+		t.Errorf("client URIs %v, want %s", consul.uris, want)
+	}
+}
+
+func TestConnectAuthorizeDeniedUntilDatacenterLoaded(t *testing.T) {
+	consul := &testConnectConsul{}
+	agent := testConnectAgent(t, consul, &Config{ConnectService: "goc-proxy"})
+	if err := agent.queryDatacenter(); err == nil {
+		t.Fatal("datacenter loaded from a failed agent query")
+	}
+	if _, err := agent.Authorize("web", "api"); err == nil {
+		t.Fatal("route authorized without a datacenter")
+	}
+	if len(consul.uris) != 0 {
+		t.Errorf("authorize called with %v", consul.uris)
+	}
+
+	consul.datacenter = "dc2"
+	if err := agent.queryDatacenter(); err != nil {
+		t.Fatal(err)
+	}
+	if authorized, err := agent.Authorize("web", "api"); err != nil || !authorized {
+		t.Fatalf("route authorized %v: %v", authorized, err)
+	}
+	if want := "spiffe://11111111-2222.consul/ns/default/dc/dc2/svc/web"; consul.uris[0] != want {
+		t.Errorf("client URI %s, want %s", consul.uris[0], want)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul_api "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-cleanhttp"
+)
+
+const (
+	// base retry interval of a failed blocking query
+	watchRetryInterval = 5 * time.Second
+	// maximum back off time of a failed blocking query
+	watchMaxBackoff = 180 * time.Second
+)
+
+// newConsulClient creates the Consul client shared by all workers,
+// settings left empty fall back to the CONSUL_HTTP_* environment variables
+func newConsulClient(config *Config) (*consul_api.Client, *consul_api.Config, error) {
+	consulConfig := consul_api.DefaultConfig()
+	if config.ConsulAddress != "" {
+		consulConfig.Address = config.ConsulAddress
+	}
+	if config.ConsulScheme != "" {
+		consulConfig.Scheme = config.ConsulScheme
+	}
+	if config.ConsulDatacenter != "" {
+		consulConfig.Datacenter = config.ConsulDatacenter
+	}
+
+	if config.ConsulToken != "" && config.ConsulTokenFile != "" {
+		return nil, nil, fmt.Errorf("ConsulToken and ConsulTokenFile are mutually exclusive")
+	}
+	if config.ConsulToken != "" {
+		consulConfig.Token = config.ConsulToken
+	}
+	if config.ConsulTokenFile != "" {
+		data, err := ioutil.ReadFile(config.ConsulTokenFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Consul token file error %v", err)
+		}
+		consulConfig.Token = strings.TrimSpace(string(data))
+	}
+
+	if config.ConsulCAFile != "" || config.ConsulCertFile != "" || config.ConsulKeyFile != "" {
+		if (config.ConsulCertFile == "") != (config.ConsulKeyFile == "") {
+			return nil, nil, fmt.Errorf("ConsulCertFile and ConsulKeyFile must be set together")
+		}
+		tlsConfig, err := consul_api.SetupTLSConfig(&consul_api.TLSConfig{
+			Address:  consulConfig.Address,
+			CAFile:   config.ConsulCAFile,
+			CertFile: config.ConsulCertFile,
+			KeyFile:  config.ConsulKeyFile,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("Consul TLS error %v", err)
+		}
+		transport := cleanhttp.DefaultPooledTransport()
+		transport.TLSClientConfig = tlsConfig
+		consulConfig.HttpClient.Transport = transport
+		if config.ConsulScheme == "" {
+			consulConfig.Scheme = "https"
+		}
+	}
+
+	client, err := consul_api.NewClient(consulConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, consulConfig, nil
+}
+
+// watchQuery runs a Consul blocking query loop against the endpoint until stop is closed.
+// The handler is invoked with a freshly allocated result each time the index changes,
+// the optional report func is invoked with the outcome of every query.
+func watchQuery(client *consul_api.Client, endpoint string, stop <-chan struct{}, alloc func() interface{}, handler func(uint64, interface{}), report func(error)) {
+	var index uint64
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		out := alloc()
+		meta, err := client.Raw().Query(endpoint, out, &consul_api.QueryOptions{WaitIndex: index})
+
+		// the query could have blocked for a while
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if report != nil {
+			report(err)
+		}
+		if err != nil {
+			failures++
+			retry := watchBackoff(failures)
+			log.Warnf("Consul watch %s error %s, retry in %v", endpoint, err.Error(), retry)
+			select {
+			case <-time.After(retry):
+				continue
+			case <-stop:
+				return
+			}
+		}
+		failures = 0
+
+		switch {
+		case meta.LastIndex == 0 || meta.LastIndex < index:
+			// reset a zero or backwards index, e.g. after a Consul snapshot restore,
+			// to 1 since a query with index 0 returns without blocking
+			if index == 1 {
+				continue
+			}
+			index = 1
+		case meta.LastIndex == index:
+			continue
+		default:
+			index = meta.LastIndex
+		}
+		handler(index, out)
+	}
+}
+
+// consulErrorCause classifies a Consul API error for the sync error metrics
+func consulErrorCause(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return syncErrorTimeout
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection refused") || strings.Contains(msg, "no such host") || strings.Contains(msg, "dial "):
+		return syncErrorUnreachable
+	case strings.Contains(msg, "Unexpected response code: 403") || strings.Contains(msg, "ACL not found") || strings.Contains(msg, "Permission denied"):
+		return syncErrorACL
+	case strings.Contains(msg, "Unexpected response code: 5"):
+		return syncErrorServer
+	}
+	return syncErrorOther
+}
+
+// watchBackoff returns the exponential retry interval after consecutive failures
+func watchBackoff(failures int) time.Duration {
+	retry := watchRetryInterval * time.Duration(failures*failures)
+	if retry > watchMaxBackoff {
+		retry = watchMaxBackoff
+	}
+	return retry
+}
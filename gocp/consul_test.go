@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+func TestWatchQueryIndexReset(t *testing.T) {
+	// the agent index goes 0, 10, 5 then stays at 5
+	indexes := []string{"0", "10", "5"}
+	var mutex sync.Mutex
+	var waits []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		waits = append(waits, req.URL.Query().Get("index"))
+		n := len(waits)
+		mutex.Unlock()
+		index := "5"
+		if n <= len(indexes) {
+			index = indexes[n-1]
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+		w.Header().Set("X-Consul-Index", index)
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+	client, err := consul_api.NewClient(&consul_api.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var handled []uint64
+	done := make(chan struct{})
+	go func() {
+		watchQuery(client, "/v1/catalog/services", stop,
+			func() interface{} { return &map[string][]string{} },
+			func(idx uint64, data interface{}) { handled = append(handled, idx) }, nil)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	<-done
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, wait := range waits[:4] {
+		want := []string{"", "1", "10", "1"}[i]
+		if wait != want && !(want == "" && wait == "0") {
+			t.Errorf("query %v waited on index %q, want %q", i, wait, want)
+		}
+	}
+	for _, wait := range waits[1:] {
+		if wait == "0" || wait == "" {
+			t.Fatalf("query without blocking index after the first one: %v", waits)
+		}
+	}
+	if fmt.Sprint(handled[:3]) != "[1 10 1]" {
+		t.Errorf("handled indexes %v, want [1 10 1 ...]", handled)
+	}
+}
+
+func TestNewConsulClient(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600)
+	tests := []struct {
+		name       string
+		config     Config
+		address    string
+		scheme     string
+		datacenter string
+		token      string
+		err        string
+	}{
+		{name: "defaults", config: Config{ConsulAddress: "127.0.0.1:8500"}, address: "127.0.0.1:8500", scheme: "http"},
+		{name: "settings", config: Config{ConsulAddress: "consul:8501", ConsulScheme: "https", ConsulDatacenter: "dc2", ConsulToken: "token"},
+			address: "consul:8501", scheme: "https", datacenter: "dc2", token: "token"},
+		{name: "token file", config: Config{ConsulAddress: "127.0.0.1:8500", ConsulTokenFile: tokenFile}, address: "127.0.0.1:8500", scheme: "http", token: "file-token"},
+		{name: "token and file", config: Config{ConsulToken: "token", ConsulTokenFile: tokenFile}, err: "mutually exclusive"},
+		{name: "missing token file", config: Config{ConsulTokenFile: filepath.Join(dir, "missing")}, err: "token file"},
+		{name: "cert without key", config: Config{ConsulCertFile: filepath.Join(dir, "cert.pem")}, err: "set together"},
+		{name: "missing CA", config: Config{ConsulCAFile: filepath.Join(dir, "missing.pem")}, err: "Consul TLS"},
+	}
+	for _, tt := range tests {
+		client, consulConfig, err := newConsulClient(&tt.config)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || client == nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if consulConfig.Address != tt.address || consulConfig.Scheme != tt.scheme || consulConfig.Datacenter != tt.datacenter || consulConfig.Token != tt.token {
+			t.Errorf("%s: config %s %s %s %q, want %s %s %s %q", tt.name, consulConfig.Address, consulConfig.Scheme, consulConfig.Datacenter,
+				consulConfig.Token, tt.address, tt.scheme, tt.datacenter, tt.token)
+		}
+	}
+}
+
+func TestNewConsulClientTLS(t *testing.T) {
+	tokens := make(chan string, 1)
+	consul := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tokens <- req.Header.Get("X-Consul-Token")
+		fmt.Fprint(w, `"10.0.0.1:8300"`)
+	}))
+	defer consul.Close()
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: consul.Certificate().Raw}), 0644)
+
+	// the scheme defaults to https with TLS files and the server is verified with the CA
+	client, consulConfig, err := newConsulClient(&Config{ConsulAddress: consul.Listener.Addr().String(), ConsulCAFile: ca, ConsulToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consulConfig.Scheme != "https" {
+		t.Errorf("scheme %s, want https", consulConfig.Scheme)
+	}
+	leader, err := client.Status().Leader()
+	if err != nil || leader != "10.0.0.1:8300" {
+		t.Fatalf("leader %q %v", leader, err)
+	}
+	if token := <-tokens; token != "token" {
+		t.Errorf("token %q, want token", token)
+	}
+
+	// without the CA the server certificate is rejected
+	client, _, err = newConsulClient(&Config{ConsulAddress: consul.Listener.Addr().String(), ConsulScheme: "https"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Status().Leader(); err == nil {
+		t.Error("untrusted server certificate accepted")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DNSProvider resolves services from DNS SRV records
+type DNSProvider struct {
+	Config   *Config
+	Registry *Registry
+	// SRV record names by service name
+	Records  map[string]string
+	resolver *net.Resolver
+	catalog  map[string][]Endpoint
+	stopChan chan struct{}
+}
+
+// NewDNSProvider creates the DNS SRV provider from the service=record list
+func NewDNSProvider(config *Config, registry *Registry) (*DNSProvider, error) {
+	records := make(map[string]string)
+	for _, s := range strings.Split(config.DNSServices, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid DNS service %s expected service=record", s)
+		}
+		records[kv[0]] = kv[1]
+	}
+
+	resolver := net.DefaultResolver
+	if config.DNSResolver != "" {
+		server := config.DNSResolver
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return &DNSProvider{
+		Config:   config,
+		Registry: registry,
+		Records:  records,
+		resolver: resolver,
+		catalog:  make(map[string][]Endpoint),
+		stopChan: make(chan struct{}),
+	}, nil
+}
+
+// Name returns the provider name
+func (p *DNSProvider) Name() string {
+	return providerDNS
+}
+
+// Start resolves the SRV records periodically
+func (p *DNSProvider) Start() {
+	p.resolve()
+	ticker := time.NewTicker(time.Duration(p.Config.DNSInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.resolve()
+		}
+	}
+}
+
+// Stop ends the DNS polling
+func (p *DNSProvider) Stop() {
+	close(p.stopChan)
+}
+
+// resolve looks up all records, a failed lookup keeps the last known endpoints of that service
+func (p *DNSProvider) resolve() {
+	start := time.Now()
+	cause := ""
+	catalog := make(map[string][]Endpoint)
+	for service, record := range p.Records {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, srvs, err := p.resolver.LookupSRV(ctx, "", "", record)
+		cancel()
+		if err != nil {
+			log.Warnf("DNS provider lookup %s error %s", record, err.Error())
+			cause = syncErrorLookup
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsTimeout {
+				cause = syncErrorTimeout
+			}
+			if endpoints, ok := p.catalog[service]; ok {
+				catalog[service] = endpoints
+			}
+			continue
+		}
+		catalog[service] = srvEndpoints(srvs)
+	}
+	p.catalog = catalog
+	if p.Registry.Update(providerDNS, catalog) {
+		log.Infof("Registry has been updated from DNS to version %v", p.Registry.Snapshot().Version)
+	}
+	observeSync(providerDNS, syncFull, start, cause)
+}
+
+// srvEndpoints returns the endpoints of the lowest priority records,
+// higher priorities are only meant to be used as fallback.
+// The endpoints are sorted by target and port so the registry does not change
+// with the resolver order, the SRV weight is the endpoint routing weight.
+func srvEndpoints(srvs []*net.SRV) []Endpoint {
+	var records []*net.SRV
+	weighted := false
+	for _, srv := range srvs {
+		// records are sorted by priority
+		if srv.Priority != srvs[0].Priority {
+			break
+		}
+		records = append(records, srv)
+		weighted = weighted || srv.Weight > 0
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Target != records[j].Target {
+			return records[i].Target < records[j].Target
+		}
+		return records[i].Port < records[j].Port
+	})
+
+	var endpoints []Endpoint
+	for _, srv := range records {
+		target := strings.TrimSuffix(srv.Target, ".")
+		weight := defaultWeight
+		if weighted {
+			// a zero weight record gets the smallest share of the requests
+			weight = int(srv.Weight)
+			if weight == 0 {
+				weight = 1
+			}
+		}
+		endpoints = append(endpoints, Endpoint{
+			Address: fmt.Sprintf("%s:%v", target, srv.Port),
+			Node:    target,
+			Weight:  weight,
+		})
+	}
+	return endpoints
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSRVEndpoints(t *testing.T) {
+	tests := []struct {
+		name string
+		srvs []*net.SRV
+		want []Endpoint
+	}{
+		{
+			name: "sorted by target and port",
+			srvs: []*net.SRV{
+				{Target: "b.example.", Port: 80, Priority: 1},
+				{Target: "a.example.", Port: 81, Priority: 1},
+				{Target: "a.example.", Port: 80, Priority: 1},
+			},
+			want: []Endpoint{
+				{Address: "a.example:80", Node: "a.example", Weight: defaultWeight},
+				{Address: "a.example:81", Node: "a.example", Weight: defaultWeight},
+				{Address: "b.example:80", Node: "b.example", Weight: defaultWeight},
+			},
+		},
+		{
+			name: "weights",
+			srvs: []*net.SRV{
+				{Target: "b.example.", Port: 80, Priority: 1, Weight: 0},
+				{Target: "a.example.", Port: 80, Priority: 1, Weight: 30},
+			},
+			want: []Endpoint{
+				{Address: "a.example:80", Node: "a.example", Weight: 30},
+				{Address: "b.example:80", Node: "b.example", Weight: 1},
+			},
+		},
+		{
+			name: "lowest priority only",
+			srvs: []*net.SRV{
+				{Target: "b.example.", Port: 80, Priority: 1},
+				{Target: "a.example.", Port: 80, Priority: 2},
+			},
+			want: []Endpoint{
+				{Address: "b.example:80", Node: "b.example", Weight: defaultWeight},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := srvEndpoints(tt.srvs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("endpoints %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSRVEndpointsStableSha(t *testing.T) {
+	srvs := []*net.SRV{
+		{Target: "a.example.", Port: 80, Priority: 1, Weight: 10},
+		{Target: "b.example.", Port: 80, Priority: 1, Weight: 10},
+	}
+	shuffled := []*net.SRV{srvs[1], srvs[0]}
+	sources := map[string]string{"svc": providerDNS}
+	first := makeSHA(map[string][]Endpoint{"svc": srvEndpoints(srvs)}, sources)
+	second := makeSHA(map[string][]Endpoint{"svc": srvEndpoints(shuffled)}, sources)
+	if first != second {
+		t.Error("registry Sha depends on the resolver order")
+	}
+}
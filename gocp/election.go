@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,19 +14,14 @@ type LeadershipElection struct {
 	ConsulConfig *consul_api.Config
 	Config       *Config
 	LockKey      string
-	isLeader     bool
+	isLeader     atomic.Bool
 	consulLock   *consul_api.Lock
 	stopChan     chan struct{}
 	lockChan     chan struct{}
 }
 
 // NewLeadershipElection handles the leader election when goc-proxy is in HA mode
-func NewLeadershipElection(config *Config) (*LeadershipElection, error) {
-	consulConfig := consul_api.DefaultConfig()
-	client, err := consul_api.NewClient(consulConfig)
-	if err != nil {
-		return nil, err
-	}
+func NewLeadershipElection(config *Config, client *consul_api.Client, consulConfig *consul_api.Config) (*LeadershipElection, error) {
 	lockKey := config.ElectionKeyPrefix + config.Cluster
 	opts := &consul_api.LockOptions{
 		Key: lockKey,
@@ -42,7 +38,6 @@ func NewLeadershipElection(config *Config) (*LeadershipElection, error) {
 		ConsulConfig: consulConfig,
 		Config:       config,
 		LockKey:      lockKey,
-		isLeader:     false,
 		consulLock:   lock,
 		stopChan:     make(chan struct{}, 1),
 		lockChan:     make(chan struct{}, 1),
@@ -70,9 +65,9 @@ func (e *LeadershipElection) Start() {
 			}
 			if electionChan != nil {
 				log.Info("Acting as elected leader.")
-				e.isLeader = true
+				e.setLeader(true)
 				<-electionChan
-				e.isLeader = false
+				e.setLeader(false)
 				log.Warn("Leadership lost, releasing lock.")
 				e.consulLock.Unlock()
 			} else {
@@ -88,7 +83,25 @@ func (e *LeadershipElection) Stop() {
 	e.stopChan <- struct{}{}
 	e.lockChan <- struct{}{}
 	e.consulLock.Unlock()
-	e.isLeader = false
+	e.setLeader(false)
+}
+
+// IsLeader returns the leadership status
+func (e *LeadershipElection) IsLeader() bool {
+	return e.isLeader.Load()
+}
+
+// setLeader updates the leadership status and its metrics, it is called by the
+// election routine and by Stop
+func (e *LeadershipElection) setLeader(leader bool) {
+	if e.isLeader.Swap(leader) != leader {
+		proxy_leader_changes_total.Inc()
+	}
+	if leader {
+		proxy_leader.Set(1)
+	} else {
+		proxy_leader.Set(0)
+	}
 }
 
 // GetLeader returns the leader name from Consul session
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLeadershipElectionSetLeader(t *testing.T) {
+	e := &LeadershipElection{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(leader bool) {
+			defer wg.Done()
+			e.setLeader(leader)
+			e.IsLeader()
+		}(i%2 == 0)
+	}
+	wg.Wait()
+	e.setLeader(true)
+	if !e.IsLeader() {
+		t.Error("proxy is not leader after setLeader(true)")
+	}
+	e.setLeader(false)
+	if e.IsLeader() {
+		t.Error("proxy is leader after setLeader(false)")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+const problemJSON = "application/problem+json"
+
+// Problem is a RFC 7807 error document, custom templates are executed with it
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Service   string `json:"service,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorTemplate renders a problem for a media type
+type errorTemplate interface {
+	Execute(io.Writer, interface{}) error
+}
+
+// ErrorPages writes the proxy error responses as problem+json
+// or with the custom template matching the request Accept header
+type ErrorPages struct {
+	templates map[string]errorTemplate
+	// media types in configuration order, used when Accept matches several templates
+	types []string
+}
+
+// NewErrorPages parses the custom error templates from config, a comma separated list of
+// media-type=path, HTML templates are escaped
+func NewErrorPages(config *Config) (*ErrorPages, error) {
+	p := &ErrorPages{templates: make(map[string]errorTemplate)}
+	for _, entry := range strings.Split(config.ErrorTemplates, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid error template %s, expected media-type=path", entry)
+		}
+		mediaType := strings.ToLower(parts[0])
+		var t errorTemplate
+		var err error
+		if mediaType == "text/html" {
+			t, err = htmltemplate.ParseFiles(parts[1])
+		} else {
+			t, err = texttemplate.ParseFiles(parts[1])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error template %s: %v", parts[1], err)
+		}
+		p.templates[mediaType] = t
+		p.types = append(p.types, mediaType)
+	}
+	return p, nil
+}
+
+// Write sends the error response for the request
+func (p *ErrorPages) Write(w http.ResponseWriter, req *http.Request, status int, service string, detail string) {
+	problem := &Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  req.RequestURI,
+		Service:   service,
+		RequestID: requestIDFrom(req.Context()),
+	}
+
+	if problem.Instance == "" {
+		problem.Instance = req.URL.RequestURI()
+	}
+
+	mediaType := p.negotiate(req.Header.Get("Accept"))
+	var body bytes.Buffer
+	if t, ok := p.templates[mediaType]; ok {
+		if err := t.Execute(&body, problem); err != nil {
+			requestLog(req).Errorf("xproxy: error template %s failed %s", mediaType, err.Error())
+			body.Reset()
+			mediaType = problemJSON
+		}
+	} else {
+		mediaType = problemJSON
+	}
+	if mediaType == problemJSON {
+		json.NewEncoder(&body).Encode(problem)
+	} else if !strings.Contains(mediaType, "charset") {
+		mediaType += "; charset=utf-8"
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", mediaType)
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	body.WriteTo(w)
+}
+
+// UpstreamError maps a round trip error to 504 on timeouts and 502 otherwise
+func (p *ErrorPages) UpstreamError(w http.ResponseWriter, req *http.Request, service string, err error) {
+	if req.Context().Err() == context.Canceled {
+		// the client went away, nobody reads the response
+		requestLog(req).Debugf("xproxy: service %s request canceled by client", service)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	status := http.StatusBadGateway
+	detail := fmt.Sprintf("service %s is unreachable", service)
+	var netErr net.Error
+	if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+		detail = fmt.Sprintf("service %s timed out", service)
+	}
+	requestLog(req).Errorf("xproxy: service %s round trip error %s", service, err.Error())
+	p.Write(w, req, status, service, detail)
+}
+
+// negotiate returns the custom template media type preferred by the Accept header,
+// problem+json when none matches
+func (p *ErrorPages) negotiate(accept string) string {
+	if accept == "" || len(p.types) == 0 {
+		return problemJSON
+	}
+	best, bestQ := problemJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		if mediaType == problemJSON || mediaType == "application/json" || mediaType == "*/*" {
+			best, bestQ = problemJSON, q
+			continue
+		}
+		for _, t := range p.types {
+			if matchMediaType(mediaType, t) {
+				best, bestQ = t, q
+				break
+			}
+		}
+	}
+	return best
+}
+
+// matchMediaType matches an Accept media range, such as text/*, against a media type
+func matchMediaType(accepted string, mediaType string) bool {
+	if accepted == mediaType {
+		return true
+	}
+	return strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, accepted[:len(accepted)-1])
+}
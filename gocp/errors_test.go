@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testErrorPages loads HTML and plain text error templates from a temp dir
+func testErrorPages(t *testing.T) *ErrorPages {
+	dir := t.TempDir()
+	html := filepath.Join(dir, "error.html")
+	text := filepath.Join(dir, "error.txt")
+	ioutil.WriteFile(html, []byte("<h1>{{.Status}} {{.Title}}</h1><p>{{.Detail}}</p>"), 0644)
+	ioutil.WriteFile(text, []byte("{{.Status}} {{.Detail}}"), 0644)
+	p, err := NewErrorPages(&Config{ErrorTemplates: "text/html=" + html + ",text/plain=" + text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestErrorPagesNegotiation(t *testing.T) {
+	pages := testErrorPages(t)
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{accept: "", contentType: problemJSON},
+		{accept: "application/json", contentType: problemJSON},
+		{accept: "*/*", contentType: problemJSON},
+		{accept: "image/png", contentType: problemJSON},
+		{accept: "text/html", contentType: "text/html; charset=utf-8", body: "<h1>502 Bad Gateway</h1><p>service &lt;echo&gt; is down</p>"},
+		{accept: "text/html;q=0.9,text/plain", contentType: "text/plain; charset=utf-8", body: "502 service <echo> is down"},
+		{accept: "text/*", contentType: "text/html; charset=utf-8"},
+		{accept: "application/problem+json, text/html;q=0.5", contentType: problemJSON},
+		{accept: "text/plain;q=0.2, */*;q=0.8", contentType: problemJSON},
+		{accept: "text/plain;q=bad, text/html;q=0.1", contentType: "text/html; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/echo/a", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		pages.Write(w, req, http.StatusBadGateway, "echo", "service <echo> is down")
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%q status %v, want 502", tt.accept, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%q content type %s, want %s", tt.accept, got, tt.contentType)
+			continue
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%q without nosniff", tt.accept)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%q body %q, want %q", tt.accept, w.Body.String(), tt.body)
+		}
+		if tt.contentType == problemJSON {
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Errorf("%q body %q: %v", tt.accept, w.Body.String(), err)
+				continue
+			}
+			want := Problem{Type: "about:blank", Title: "Bad Gateway", Status: 502, Detail: "service <echo> is down", Instance: "/echo/a", Service: "echo"}
+			if problem != want {
+				t.Errorf("%q problem %+v, want %+v", tt.accept, problem, want)
+			}
+		}
+	}
+
+	// without templates every request gets problem+json
+	pages, err := NewErrorPages(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/echo/a", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	pages.Write(w, req, http.StatusNotFound, "echo", "")
+	if got := w.Header().Get("Content-Type"); got != problemJSON {
+		t.Errorf("content type without templates %s", got)
+	}
+}
+
+func TestNewErrorPagesErrors(t *testing.T) {
+	for _, templates := range []string{"text/html", "=error.html", "text/html=", "text/html=" + filepath.Join(t.TempDir(), "missing.html")} {
+		if _, err := NewErrorPages(&Config{ErrorTemplates: templates}); err == nil {
+			t.Errorf("%q: expected an error", templates)
+		}
+	}
+}
+
+// timeoutError is a net.Error timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	_, refused := net.Dial("tcp", closedAddress(t))
+	if refused == nil {
+		t.Fatal("expected a refused connection")
+	}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		detail string
+	}{
+		{name: "refused", err: refused, status: http.StatusBadGateway, detail: "service echo is unreachable"},
+		{name: "net timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, status: http.StatusGatewayTimeout, detail: "service echo timed out"},
+		{name: "deadline", err: context.DeadlineExceeded, status: http.StatusGatewayTimeout, detail: "service echo timed out"},
+		{name: "other", err: errors.New("EOF"), status: http.StatusBadGateway, detail: "service echo is unreachable"},
+	}
+	pages := testErrorPages(t)
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		pages.UpstreamError(w, httptest.NewRequest(http.MethodGet, "/echo/", nil), "echo", tt.err)
+		var problem Problem
+		json.Unmarshal(w.Body.Bytes(), &problem)
+		if w.Code != tt.status || problem.Detail != tt.detail {
+			t.Errorf("%s: status %v detail %q, want %v %q", tt.name, w.Code, problem.Detail, tt.status, tt.detail)
+		}
+	}
+
+	// a canceled request gets no body
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	pages.UpstreamError(w, httptest.NewRequest(http.MethodGet, "/echo/", nil).WithContext(ctx), "echo", context.Canceled)
+	if w.Code != http.StatusBadGateway || w.Body.Len() != 0 {
+		t.Errorf("canceled request status %v body %q", w.Code, w.Body.String())
+	}
+}
+
+// closedAddress returns a local address nothing listens on
+func closedAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestReverseHandlerErrorStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	proxy := testReverseProxy(t, backend.URL, nil)
+	proxy.Registry.Update(providerFile, map[string][]Endpoint{
+		"echo":    {{Address: backend.Listener.Addr().String()}},
+		"refused": {{Address: closedAddress(t)}},
+		// Connect endpoints are not available with Connect disabled
+		"connect": {{Address: backend.Listener.Addr().String(), Connect: true}},
+	})
+	handler := proxy.ReverseHandlerFunc()
+
+	tests := []struct {
+		target  string
+		timeout time.Duration
+		status  int
+	}{
+		{target: "/echo/", timeout: 50 * time.Millisecond, status: http.StatusGatewayTimeout},
+		{target: "/refused/", status: http.StatusBadGateway},
+		{target: "/connect/", status: http.StatusServiceUnavailable},
+		{target: "/missing/", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.timeout > 0 {
+			ctx, cancel := context.WithTimeout(req.Context(), tt.timeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s status %v, want %v", tt.target, w.Code, tt.status)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), problemJSON) {
+			t.Errorf("%s content type %s", tt.target, w.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// service exposure modes
+const (
+	exposeAll    = "all"
+	exposeTagged = "tagged"
+)
+
+// ExposeRules decide which Consul services are routed by goc-proxy.
+// Excluded services and services tagged with <tag>=false are never exposed.
+// In tagged mode a service must carry the expose tag or match the include list,
+// in all mode a non empty include list restricts the exposed services to the matching ones.
+type ExposeRules struct {
+	Tagged  bool
+	Tag     string
+	Include []*namePattern
+	Exclude []*namePattern
+}
+
+// namePattern matches service names with a glob or, when prefixed with re:, a regular expression
+type namePattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+// NewExposeRules creates the exposure rules from config
+func NewExposeRules(config *Config) (*ExposeRules, error) {
+	if config.ExposeTag == "" {
+		return nil, fmt.Errorf("ExposeTag is required")
+	}
+	rules := &ExposeRules{Tag: config.ExposeTag}
+	switch config.ExposeMode {
+	case exposeAll:
+	case exposeTagged:
+		rules.Tagged = true
+	default:
+		return nil, fmt.Errorf("unknown expose mode %s", config.ExposeMode)
+	}
+
+	var err error
+	if rules.Include, err = parseNamePatterns(config.ExposeInclude); err != nil {
+		return nil, err
+	}
+	if rules.Exclude, err = parseNamePatterns(config.ExposeExclude); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Exposed reports if the service with the given tags can be routed
+func (r *ExposeRules) Exposed(service string, tags []string) bool {
+	if r == nil {
+		return true
+	}
+	if matchAny(r.Exclude, service) {
+		return false
+	}
+	value, tagged := tagValue(tags, r.Tag)
+	if tagged && value == "false" {
+		return false
+	}
+	if r.Tagged {
+		return tagged || matchAny(r.Include, service)
+	}
+	return len(r.Include) == 0 || matchAny(r.Include, service)
+}
+
+// parseNamePatterns splits a comma separated list of globs and re: prefixed regular expressions
+func parseNamePatterns(list string) ([]*namePattern, error) {
+	var patterns []*namePattern
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if strings.HasPrefix(p, "re:") {
+			regex, err := regexp.Compile(p[len("re:"):])
+			if err != nil {
+				return nil, fmt.Errorf("invalid service pattern %s: %v", p, err)
+			}
+			patterns = append(patterns, &namePattern{regex: regex})
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid service pattern %s: %v", p, err)
+		}
+		patterns = append(patterns, &namePattern{glob: p})
+	}
+	return patterns, nil
+}
+
+func (p *namePattern) match(name string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+func matchAny(patterns []*namePattern, name string) bool {
+	for _, p := range patterns {
+		if p.match(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExposeRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		include string
+		exclude string
+		service string
+		tags    []string
+		want    bool
+	}{
+		{name: "all", mode: exposeAll, service: "web", want: true},
+		{name: "all opt out", mode: exposeAll, service: "web", tags: []string{"goc.expose=false"}, want: false},
+		{name: "all excluded", mode: exposeAll, exclude: "consul,vault", service: "consul", want: false},
+		{name: "all excluded glob", mode: exposeAll, exclude: "internal-*", service: "internal-db", want: false},
+		{name: "all include restricts", mode: exposeAll, include: "web*", service: "api", want: false},
+		{name: "all include matches", mode: exposeAll, include: "web*", service: "web-v2", want: true},
+		{name: "all include regex", mode: exposeAll, include: "re:^api-v[0-9]+$", service: "api-v2", want: true},
+		{name: "all include regex mismatch", mode: exposeAll, include: "re:^api-v[0-9]+$", service: "api-beta", want: false},
+		{name: "exclude wins over include", mode: exposeAll, include: "web*", exclude: "web-admin", service: "web-admin", want: false},
+		{name: "tagged without tag", mode: exposeTagged, service: "web", want: false},
+		{name: "tagged with tag", mode: exposeTagged, service: "web", tags: []string{"goc.expose"}, want: true},
+		{name: "tagged with true", mode: exposeTagged, service: "web", tags: []string{"goc.expose=true"}, want: true},
+		{name: "tagged with false", mode: exposeTagged, service: "web", tags: []string{"goc.expose=false"}, want: false},
+		{name: "tagged included", mode: exposeTagged, include: "web", service: "web", want: true},
+		{name: "tagged included opt out", mode: exposeTagged, include: "web", service: "web", tags: []string{"goc.expose=false"}, want: false},
+		{name: "tagged excluded", mode: exposeTagged, exclude: "web", service: "web", tags: []string{"goc.expose"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := NewExposeRules(&Config{ExposeMode: tt.mode, ExposeTag: tagExpose, ExposeInclude: tt.include, ExposeExclude: tt.exclude})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rules.Exposed(tt.service, tt.tags); got != tt.want {
+				t.Errorf("exposed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExposeRulesNil(t *testing.T) {
+	var rules *ExposeRules
+	if !rules.Exposed("web", []string{"goc.expose=false"}) {
+		t.Error("nil rules must expose every service")
+	}
+}
+
+func TestNewExposeRulesErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+	}{
+		{name: "missing tag", config: &Config{ExposeMode: exposeAll}},
+		{name: "unknown mode", config: &Config{ExposeMode: "some", ExposeTag: tagExpose}},
+		{name: "invalid glob", config: &Config{ExposeMode: exposeAll, ExposeTag: tagExpose, ExposeInclude: "web["}},
+		{name: "invalid regex", config: &Config{ExposeMode: exposeAll, ExposeTag: tagExpose, ExposeExclude: "re:web("}},
+	}
+	for _, tt := range tests {
+		if _, err := NewExposeRules(tt.config); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FileProvider loads services from a static YAML or JSON file
+// and reloads them when the file changes
+type FileProvider struct {
+	Config   *Config
+	Registry *Registry
+	modTime  time.Time
+	size     int64
+	// catalog is the last valid file catalog
+	catalog  map[string][]Endpoint
+	stopChan chan struct{}
+}
+
+// fileCatalog is the static file format:
+//
+//	services:
+//	  alpha:
+//	    - address: 10.0.0.1:8080
+//	      node: node1
+//	      tags: [goc.tls.insecure]
+//	      meta:
+//	        goc.scheme: https
+type fileCatalog struct {
+	Services map[string][]fileEndpoint `yaml:"services"`
+}
+
+type fileEndpoint struct {
+	Address string            `yaml:"address"`
+	Node    string            `yaml:"node"`
+	Tags    []string          `yaml:"tags"`
+	Meta    map[string]string `yaml:"meta"`
+}
+
+// NewFileProvider creates the static file provider
+func NewFileProvider(config *Config, registry *Registry) *FileProvider {
+	return &FileProvider{
+		Config:   config,
+		Registry: registry,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Name returns the provider name
+func (p *FileProvider) Name() string {
+	return providerFile
+}
+
+// Start loads the file and polls it for changes
+func (p *FileProvider) Start() {
+	p.reload()
+	ticker := time.NewTicker(time.Duration(p.Config.ProviderFileInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.reload()
+		}
+	}
+}
+
+// Stop ends the file polling
+func (p *FileProvider) Stop() {
+	close(p.stopChan)
+}
+
+// reload applies the file if its size or modification time changed,
+// an invalid file is ignored and the last good catalog is kept.
+// The catalog is applied on every reload so each one counts as a sync for the registry guard.
+func (p *FileProvider) reload() {
+	start := time.Now()
+	info, err := os.Stat(p.Config.ProviderFile)
+	if err != nil {
+		log.Errorf("File provider error %s", err.Error())
+		observeSync(providerFile, syncFull, start, syncErrorIO)
+		p.update()
+		return
+	}
+	if !info.ModTime().Equal(p.modTime) || info.Size() != p.size {
+		catalog, err := loadFileCatalog(p.Config.ProviderFile)
+		if err != nil {
+			log.Errorf("File provider %s is invalid, keeping the last catalog: %s", p.Config.ProviderFile, err.Error())
+			observeSync(providerFile, syncFull, start, syncErrorInvalid)
+			p.update()
+			return
+		}
+		// an invalid file is parsed and reported again on the next reload
+		p.modTime = info.ModTime()
+		p.size = info.Size()
+		p.catalog = catalog
+	}
+	p.update()
+	observeSync(providerFile, syncFull, start, "")
+}
+
+// update applies the last good catalog, the provider syncs with no services
+// until a valid file is loaded so a file missing at start doesn't keep the disk cache routes forever
+func (p *FileProvider) update() {
+	catalog := p.catalog
+	if catalog == nil {
+		catalog = make(map[string][]Endpoint)
+	}
+	if p.Registry.Update(providerFile, catalog) {
+		log.Infof("Registry has been updated from %s to version %v", p.Config.ProviderFile, p.Registry.Snapshot().Version)
+	}
+}
+
+// loadFileCatalog parses a YAML or JSON services file, JSON being a subset of YAML
+func loadFileCatalog(path string) (map[string][]Endpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file fileCatalog
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	catalog := make(map[string][]Endpoint)
+	for service, endpoints := range file.Services {
+		for _, e := range endpoints {
+			if e.Address == "" {
+				return nil, fmt.Errorf("service %s has an endpoint with no address", service)
+			}
+			catalog[service] = append(catalog[service], Endpoint{
+				Address: e.Address,
+				Node:    e.Node,
+				Tags:    e.Tags,
+				Meta:    e.Meta,
+			})
+		}
+	}
+	return catalog, nil
+}
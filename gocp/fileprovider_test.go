@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileProviderMissingFileSyncs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.yaml")
+
+	registry := NewRegistry([]string{providerFile})
+	registry.Update(providerCache, map[string][]Endpoint{"cached": {{Address: "10.0.0.1:80"}}})
+	if !registry.Snapshot().Stale {
+		t.Fatal("cache routes are not stale")
+	}
+
+	p := NewFileProvider(&Config{ProviderFile: path}, registry)
+	p.reload()
+	snapshot := registry.Snapshot()
+	if snapshot.Stale {
+		t.Error("missing file kept the stale cache routes")
+	}
+	if _, err := registry.Lookup("cached"); err == nil {
+		t.Error("cached service is still routed")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("services:\n  alpha:\n    - address: 10.0.0.2:80\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.reload()
+	if _, err := registry.Lookup("alpha"); err != nil {
+		t.Error(err)
+	}
+
+	// a removed file keeps the last good catalog
+	os.Remove(path)
+	p.reload()
+	if _, err := registry.Lookup("alpha"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileProviderInvalidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.yaml")
+	ioutil.WriteFile(path, []byte("services:\n  alpha:\n    - node: n1\n"), 0644)
+
+	registry := NewRegistry([]string{providerFile})
+	p := NewFileProvider(&Config{ProviderFile: path}, registry)
+	p.reload()
+	if !p.modTime.IsZero() {
+		t.Error("invalid file is not parsed again on the next reload")
+	}
+	if _, err := registry.Lookup("alpha"); err == nil {
+		t.Error("invalid file applied")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// tagAlertErrorRate overrides the error rate alert threshold of a service, e.g. goc.alert.errorrate=0.01
+const tagAlertErrorRate = "goc.alert.errorrate"
+
+// promDuration is a Prometheus range duration such as 5m
+var promDuration = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d|w|y)$`)
+
+// Generator builds a Grafana dashboard and Prometheus alert rules for the services of the registry
+type Generator struct {
+	// ErrorRate is the default share of failed round trips that fires the error rate alert
+	ErrorRate float64
+	// Window is the rate range and the alert pending period
+	Window string
+}
+
+// NewGenerator creates the dashboard and rules generator from config
+func NewGenerator(config *Config) (*Generator, error) {
+	if config.AlertErrorRate <= 0 || config.AlertErrorRate > 1 {
+		return nil, fmt.Errorf("AlertErrorRate must be between 0 and 1")
+	}
+	if !promDuration.MatchString(config.AlertWindow) {
+		return nil, fmt.Errorf("AlertWindow %s is not a Prometheus duration, e.g. 5m", config.AlertWindow)
+	}
+	return &Generator{ErrorRate: config.AlertErrorRate, Window: config.AlertWindow}, nil
+}
+
+// prometheusRules is the Prometheus rules file format
+type prometheusRules struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// errorRatioExpr is the share of round trips answered with 5xx or failed by a transport error
+func (g *Generator) errorRatioExpr(service string) string {
+	selector := fmt.Sprintf(`{service=%q}`, service)
+	// each sum defaults to 0 so a service with no 5xx or no transport error still has a ratio
+	failed := fmt.Sprintf(`(sum(rate(goc_proxy_upstream_requests_total{service=%q,code=~"5.."}[%s])) or vector(0)) + (sum(rate(goc_proxy_upstream_errors_total%s[%s])) or vector(0))`,
+		service, g.Window, selector, g.Window)
+	total := fmt.Sprintf(`(sum(rate(goc_proxy_upstream_requests_total%s[%s])) or vector(0)) + (sum(rate(goc_proxy_upstream_errors_total%s[%s])) or vector(0))`,
+		selector, g.Window, selector, g.Window)
+	return fmt.Sprintf("(%s) / (%s)", failed, total)
+}
+
+// errorRate returns the alert threshold of a service, set with the goc.alert.errorrate tag or the default
+func (g *Generator) errorRate(endpoints []Endpoint) float64 {
+	if value, ok := tagValue(serviceTags(endpoints), tagAlertErrorRate); ok {
+		if rate, err := strconv.ParseFloat(value, 64); err == nil && rate > 0 && rate <= 1 {
+			return rate
+		}
+	}
+	return g.ErrorRate
+}
+
+// sloRules returns the multi-window burn rate alerts of an SLO, they fire when
+// the error budget is spent faster than the burn window factor over both windows
+func sloRules(slo *SLO) []rule {
+	var rules []rule
+	for _, w := range burnWindows {
+		long, short := formatWindow(w.Long), formatWindow(w.Short)
+		rules = append(rules, rule{
+			Alert: "GocProxySLOBurnRate",
+			Expr: fmt.Sprintf(`goc_proxy_slo_burn_rate{slo=%q,window=%q} > %v and ignoring(window) goc_proxy_slo_burn_rate{slo=%q,window=%q} > %v`,
+				slo.Name, long, w.Factor, slo.Name, short, w.Factor),
+			Labels: map[string]string{"severity": w.Severity, "service": slo.Service, "slo": slo.Name},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("Service %s burns the %s error budget too fast", slo.Service, slo.Name),
+				"description": fmt.Sprintf("The %v%% objective over %s error budget is spent more than %v times faster than sustainable over the last %s and %s.",
+					slo.Objective, slo.Window, w.Factor, long, short),
+			},
+		})
+	}
+	return rules
+}
+
+// Rules returns the Prometheus alert rules of the registry services and the proxy sync alerts.
+// The services with SLOs get burn rate alerts derived from their objectives,
+// the other services get an error rate alert with a fixed threshold. Every service gets a node health alert.
+func (g *Generator) Rules(snapshot *RegistrySnapshot, slos []*SLO) *prometheusRules {
+	services := sortedServices(snapshot)
+	objectives := make(map[string][]*SLO)
+	for _, slo := range slos {
+		objectives[slo.Service] = append(objectives[slo.Service], slo)
+	}
+	group := ruleGroup{Name: "goc-proxy-services"}
+	for _, slo := range slos {
+		// the SLO alerts are kept for the services missing from the registry, it is an outage
+		if _, ok := snapshot.Catalog[slo.Service]; !ok {
+			group.Rules = append(group.Rules, sloRules(slo)...)
+		}
+	}
+	for _, service := range services {
+		if len(objectives[service]) > 0 {
+			for _, slo := range objectives[service] {
+				group.Rules = append(group.Rules, sloRules(slo)...)
+			}
+		} else {
+			rate := g.errorRate(snapshot.Catalog[service])
+			group.Rules = append(group.Rules, rule{
+				Alert:  "GocProxyServiceErrorRate",
+				Expr:   fmt.Sprintf("%s > %v", g.errorRatioExpr(service), rate),
+				For:    g.Window,
+				Labels: map[string]string{"severity": "critical", "service": service},
+				Annotations: map[string]string{
+					"summary":     fmt.Sprintf("Service %s error rate is above %v%%", service, rate*100),
+					"description": fmt.Sprintf("{{ $value | humanizePercentage }} of the %s round trips failed in the last %s.", service, g.Window),
+				},
+			})
+		}
+		group.Rules = append(group.Rules, rule{
+			Alert:  "GocProxyServiceNodeUnhealthy",
+			Expr:   fmt.Sprintf(`min by (service, node, address) (goc_proxy_service_node_status{service=%q}) == 0`, service),
+			For:    g.Window,
+			Labels: map[string]string{"severity": "warning", "service": service},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("Service %s node is unhealthy", service),
+				"description": "Node {{ $labels.node }} at {{ $labels.address }} is omitted from the goc-proxy registry.",
+			},
+		})
+	}
+	proxy := ruleGroup{Name: "goc-proxy", Rules: []rule{
+		{
+			Alert:  "GocProxyRegistryStale",
+			Expr:   "time() - goc_proxy_sync_last_success_timestamp_seconds > 300",
+			For:    g.Window,
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "goc-proxy registry is stale",
+				"description": "Provider {{ $labels.provider }} of {{ $labels.instance }} did not sync for {{ $value | humanizeDuration }}.",
+			},
+		},
+		{
+			Alert:  "GocProxyRegistryGuardActive",
+			Expr:   "goc_proxy_registry_guard_active == 1",
+			For:    g.Window,
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "goc-proxy refuses a mass deregistration",
+				"description": "{{ $labels.instance }} keeps serving the last known good registry.",
+			},
+		},
+	}}
+	return &prometheusRules{Groups: []ruleGroup{group, proxy}}
+}
+
+// Dashboard returns a Grafana dashboard with a row per registry service holding
+// the rate, errors, duration and node health panels
+func (g *Generator) Dashboard(snapshot *RegistrySnapshot) object {
+	datasource := object{"type": "prometheus", "uid": "${datasource}"}
+	var panels []object
+	id, y := 1, 0
+	panel := func(title string, unit string, x int, targets ...object) object {
+		for i, t := range targets {
+			t["refId"] = string(rune('A' + i))
+			t["datasource"] = datasource
+		}
+		p := object{
+			"id":         id,
+			"type":       "timeseries",
+			"title":      title,
+			"datasource": datasource,
+			"gridPos":    object{"h": 8, "w": 6, "x": x, "y": y},
+			"fieldConfig": object{
+				"defaults":  object{"unit": unit},
+				"overrides": []object{},
+			},
+			"targets": targets,
+		}
+		id++
+		return p
+	}
+	target := func(expr string, legend string) object {
+		return object{"expr": expr, "legendFormat": legend}
+	}
+
+	for _, service := range sortedServices(snapshot) {
+		selector := fmt.Sprintf(`{service=%q}`, service)
+		panels = append(panels, object{
+			"id":        id,
+			"type":      "row",
+			"title":     service,
+			"collapsed": false,
+			"gridPos":   object{"h": 1, "w": 24, "x": 0, "y": y},
+			"panels":    []object{},
+		})
+		id++
+		y++
+		quantile := func(q string) object {
+			return target(fmt.Sprintf("histogram_quantile(%s, sum by (le) (rate(goc_proxy_upstream_duration_seconds_bucket%s[%s])))", q, selector, g.Window), "p"+strings.TrimPrefix(q, "0."))
+		}
+		panels = append(panels,
+			panel("Rate", "reqps", 0,
+				target(fmt.Sprintf("sum by (code) (rate(goc_proxy_upstream_requests_total%s[%s]))", selector, g.Window), "{{code}}")),
+			panel("Errors", "percentunit", 6, target(g.errorRatioExpr(service), "error ratio")),
+			panel("Duration", "s", 12, quantile("0.5"), quantile("0.95"), quantile("0.99")),
+			panel("Node health", "none", 18,
+				target(fmt.Sprintf("min by (node, address) (goc_proxy_service_node_status%s)", selector), "{{node}} {{address}}")),
+		)
+		y += 8
+	}
+	if panels == nil {
+		panels = []object{}
+	}
+
+	return object{
+		"uid":           "goc-proxy-services",
+		"title":         "goc-proxy services",
+		"tags":          []string{"goc-proxy"},
+		"timezone":      "browser",
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          object{"from": "now-1h", "to": "now"},
+		"templating": object{"list": []object{{
+			"name":  "datasource",
+			"type":  "datasource",
+			"query": "prometheus",
+			"label": "Data source",
+		}}},
+		"panels": panels,
+	}
+}
+
+func sortedServices(snapshot *RegistrySnapshot) []string {
+	services := make([]string, 0, len(snapshot.Catalog))
+	for service := range snapshot.Catalog {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// writeRules writes the rules as YAML
+func (g *Generator) writeRules(w http.ResponseWriter, snapshot *RegistrySnapshot, slos []*SLO) {
+	data, err := yaml.Marshal(g.Rules(snapshot, slos))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
+
+// runGenerate is the generate subcommand, it prints the dashboard or the rules
+// built from the registry and the SLOs of the running goc-proxy at GenerateFrom
+func runGenerate(config *Config, args []string) error {
+	if len(args) != 1 || (args[0] != "dashboard" && args[0] != "rules") {
+		return fmt.Errorf("usage: gocp [flags] generate dashboard|rules")
+	}
+	g, err := NewGenerator(config)
+	if err != nil {
+		return err
+	}
+	from := config.GenerateFrom
+	if from == "" {
+		from = fmt.Sprintf("http://127.0.0.1:%v", config.Port)
+	}
+	var snapshot RegistrySnapshot
+	if err := getJSON(from, "/_/registry", &snapshot); err != nil {
+		return err
+	}
+
+	if args[0] == "rules" {
+		var statuses []*SLOStatus
+		if err := getJSON(from, "/_/slo", &statuses); err != nil {
+			return err
+		}
+		slos := make([]*SLO, 0, len(statuses))
+		for _, s := range statuses {
+			slos = append(slos, s.SLO)
+		}
+		data, err := yaml.Marshal(g.Rules(&snapshot, slos))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g.Dashboard(&snapshot))
+}
+
+// getJSON decodes the response of a goc-proxy admin endpoint
+func getJSON(from string, endpoint string, out interface{}) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(from, "/") + endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s request to %s failed with status %v", endpoint, from, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
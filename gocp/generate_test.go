@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratorRules(t *testing.T) {
+	g := &Generator{ErrorRate: 0.05, Window: "5m"}
+	snapshot := &RegistrySnapshot{Catalog: map[string][]Endpoint{
+		"billing": {{Address: "10.0.0.1:80"}},
+		"web":     {{Address: "10.0.0.2:80", Tags: []string{"goc.alert.errorrate=0.01"}}},
+	}}
+	slos := []*SLO{
+		{Name: "billing-avail", Service: "billing", Objective: 99.9, Window: "30d"},
+		{Name: "search-avail", Service: "search", Objective: 99, Window: "7d"},
+	}
+	rules := g.Rules(snapshot, slos).Groups[0].Rules
+
+	alerts := make(map[string][]rule)
+	for _, r := range rules {
+		alerts[r.Labels["service"]+"/"+r.Alert] = append(alerts[r.Labels["service"]+"/"+r.Alert], r)
+	}
+	if n := len(alerts["billing/GocProxySLOBurnRate"]); n != len(burnWindows) {
+		t.Errorf("billing has %v burn rate alerts, want %v", n, len(burnWindows))
+	}
+	if _, ok := alerts["billing/GocProxyServiceErrorRate"]; ok {
+		t.Error("billing has a fixed error rate alert despite its SLO")
+	}
+	if n := len(alerts["search/GocProxySLOBurnRate"]); n != len(burnWindows) {
+		t.Errorf("search missing from the registry has %v burn rate alerts, want %v", n, len(burnWindows))
+	}
+	web := alerts["web/GocProxyServiceErrorRate"]
+	if len(web) != 1 || !strings.HasSuffix(web[0].Expr, "> 0.01") {
+		t.Errorf("web error rate alert %+v, want the tag threshold", web)
+	}
+	page := alerts["billing/GocProxySLOBurnRate"][0]
+	want := `goc_proxy_slo_burn_rate{slo="billing-avail",window="1h"} > 14.4 and ignoring(window) goc_proxy_slo_burn_rate{slo="billing-avail",window="5m"} > 14.4`
+	if page.Expr != want || page.Labels["severity"] != "page" {
+		t.Errorf("page alert %s %v, want %s", page.Expr, page.Labels, want)
+	}
+	for _, service := range []string{"billing", "web"} {
+		if len(alerts[service+"/GocProxyServiceNodeUnhealthy"]) != 1 {
+			t.Errorf("%s has no node health alert", service)
+		}
+	}
+}
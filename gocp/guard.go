@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RegistryGuard refuses registry updates that remove a large share of services or endpoints at once,
+// unless the shrunk catalog persists across several full syncs of the provider or for the hold time
+type RegistryGuard struct {
+	// MaxServiceLoss is the maximum share of services, in percent, removed by a single update
+	MaxServiceLoss int
+	// MaxEndpointLoss is the maximum share of endpoints, in percent, removed by a single update
+	MaxEndpointLoss int
+	// Syncs is the number of consecutive full syncs a shrunk catalog must persist before being applied
+	Syncs int
+	// Hold is the time after which a shrunk catalog is applied on the next update, whatever the syncs count
+	Hold time.Duration
+	// held counts the full syncs of the providers whose updates are refused
+	held map[string]int
+	// since is the time the providers updates started to be refused
+	since map[string]time.Time
+}
+
+// NewRegistryGuard creates the guard from config, it returns nil if the guard is disabled.
+// The Consul provider must resync periodically, its watchers do not count as syncs.
+func NewRegistryGuard(config *Config, providers []string) (*RegistryGuard, error) {
+	if config.GuardSyncs <= 0 {
+		return nil, nil
+	}
+	for _, provider := range providers {
+		if provider == providerConsul && config.ResyncInterval <= 0 {
+			return nil, fmt.Errorf("GuardSyncs requires a ResyncInterval with the %s provider", providerConsul)
+		}
+	}
+	if config.GuardHold < 0 {
+		return nil, fmt.Errorf("GuardHold must not be negative")
+	}
+	return &RegistryGuard{
+		MaxServiceLoss:  config.GuardMaxServiceLoss,
+		MaxEndpointLoss: config.GuardMaxEndpointLoss,
+		Syncs:           config.GuardSyncs,
+		Hold:            time.Duration(config.GuardHold) * time.Second,
+		held:            make(map[string]int),
+		since:           make(map[string]time.Time),
+	}, nil
+}
+
+// Allow checks the next catalog of a provider update against the last known good one,
+// only the full syncs of the provider count toward releasing a shrunk catalog, the watch updates do not.
+// Once held for the hold time, the shrunk catalog is applied by any update of the provider.
+// It must be called with the registry lock held.
+func (g *RegistryGuard) Allow(provider string, current map[string][]Endpoint, next map[string][]Endpoint, full bool) bool {
+	services, endpoints, removedServices, removedEndpoints := catalogLoss(current, next)
+	serviceLoss := percent(removedServices, services)
+	endpointLoss := percent(removedEndpoints, endpoints)
+
+	if serviceLoss <= g.MaxServiceLoss && endpointLoss <= g.MaxEndpointLoss {
+		if held, ok := g.held[provider]; ok {
+			log.Infof("Registry guard released, %s catalog recovered after %v held syncs", provider, held)
+		}
+		g.release(provider)
+		return true
+	}
+
+	held := g.held[provider]
+	if full {
+		held++
+	}
+	since, ok := g.since[provider]
+	if !ok {
+		since = time.Now()
+	}
+	if held >= g.Syncs || (g.Hold > 0 && time.Since(since) >= g.Hold) {
+		log.Warnf("Registry guard applying %s update removing %v%% of services and %v%% of endpoints, it persisted across %v syncs for %v",
+			provider, serviceLoss, endpointLoss, held, time.Since(since).Round(time.Second))
+		g.release(provider)
+		return true
+	}
+	g.held[provider] = held
+	g.since[provider] = since
+
+	log.Errorf("REGISTRY GUARD: refusing %s update removing %v of %v services (%v%%) and %v of %v endpoints (%v%%), "+
+		"serving the last known good registry, held %v of %v syncs",
+		provider, removedServices, services, serviceLoss, removedEndpoints, endpoints, endpointLoss, held, g.Syncs)
+	proxy_registry_guard_blocked_total.Inc()
+	proxy_registry_guard_active.Set(1)
+	return false
+}
+
+// release forgets the held syncs of the provider, the guard stays active while another provider is held
+func (g *RegistryGuard) release(provider string) {
+	delete(g.held, provider)
+	delete(g.since, provider)
+	if len(g.held) == 0 {
+		proxy_registry_guard_active.Set(0)
+	}
+}
+
+// catalogLoss counts the services and endpoints of the current catalog missing from the next one
+func catalogLoss(current map[string][]Endpoint, next map[string][]Endpoint) (services int, endpoints int, removedServices int, removedEndpoints int) {
+	for service, list := range current {
+		services++
+		endpoints += len(list)
+		nextList, ok := next[service]
+		if !ok {
+			removedServices++
+			removedEndpoints += len(list)
+			continue
+		}
+		addresses := make(map[string]bool, len(nextList))
+		for _, e := range nextList {
+			addresses[e.Address] = true
+		}
+		for _, e := range list {
+			if !addresses[e.Address] {
+				removedEndpoints++
+			}
+		}
+	}
+	return services, endpoints, removedServices, removedEndpoints
+}
+
+func percent(part int, total int) int {
+	if total == 0 {
+		return 0
+	}
+	return part * 100 / total
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func guardedRegistry() *Registry {
+	registry := NewRegistry([]string{providerConsul, providerFile})
+	registry.Guard = &RegistryGuard{MaxServiceLoss: 50, MaxEndpointLoss: 50, Syncs: 3, held: make(map[string]int), since: make(map[string]time.Time)}
+	return registry
+}
+
+func TestRegistryGuardCountsFullSyncs(t *testing.T) {
+	registry := guardedRegistry()
+	full := map[string][]Endpoint{
+		"a": {{Address: "10.0.0.1:80"}},
+		"b": {{Address: "10.0.0.2:80"}},
+		"c": {{Address: "10.0.0.3:80"}},
+		"d": {{Address: "10.0.0.4:80"}},
+	}
+	registry.Update(providerConsul, full)
+	shrunk := map[string][]Endpoint{"a": {{Address: "10.0.0.1:80"}}}
+
+	// watch updates and other providers updates do not advance the guard
+	for i := 0; i < 5; i++ {
+		if registry.UpdateWatch(providerConsul, shrunk) {
+			t.Fatal("watch update applied while the guard holds it")
+		}
+		registry.Update(providerFile, map[string][]Endpoint{"f": {{Address: "10.0.1.1:80"}}})
+	}
+	if _, err := registry.Lookup("c"); err != nil {
+		t.Fatal("held update changed the registry")
+	}
+
+	for i := 1; i < 3; i++ {
+		if registry.Update(providerConsul, shrunk) {
+			t.Fatalf("update applied after %v full syncs", i)
+		}
+	}
+	if !registry.Update(providerConsul, shrunk) {
+		t.Fatal("update held after 3 full syncs")
+	}
+	if _, err := registry.Lookup("c"); err == nil {
+		t.Fatal("service c is still routed")
+	}
+}
+
+func TestRegistryGuardKeepsSourceUntilAccepted(t *testing.T) {
+	registry := guardedRegistry()
+	registry.Update(providerConsul, map[string][]Endpoint{
+		"a": {{Address: "10.0.0.1:80"}},
+		"b": {{Address: "10.0.0.2:80"}},
+	})
+	registry.Update(providerConsul, map[string][]Endpoint{})
+
+	// a change of another provider must not publish the held catalog
+	registry.Update(providerFile, map[string][]Endpoint{"f": {{Address: "10.0.1.1:80"}}})
+	for _, service := range []string{"a", "b", "f"} {
+		if _, err := registry.Lookup(service); err != nil {
+			t.Errorf("service %s not routed: %v", service, err)
+		}
+	}
+}
+
+func TestRegistryGuardRelease(t *testing.T) {
+	registry := guardedRegistry()
+	full := map[string][]Endpoint{
+		"a": {{Address: "10.0.0.1:80"}},
+		"b": {{Address: "10.0.0.2:80"}},
+	}
+	registry.Update(providerConsul, full)
+	registry.Update(providerConsul, map[string][]Endpoint{})
+	registry.Update(providerConsul, map[string][]Endpoint{})
+	if registry.Guard.held[providerConsul] != 2 {
+		t.Fatalf("held %v syncs, want 2", registry.Guard.held[providerConsul])
+	}
+	registry.Update(providerConsul, full)
+	if _, ok := registry.Guard.held[providerConsul]; ok {
+		t.Fatal("guard still holds the recovered provider")
+	}
+}
+
+func TestRegistryGuardAppliesShrinkAfterHold(t *testing.T) {
+	registry := guardedRegistry()
+	registry.Guard.Hold = time.Minute
+	registry.Update(providerConsul, map[string][]Endpoint{
+		"a": {{Address: "10.0.0.1:80"}},
+		"b": {{Address: "10.0.0.2:80"}},
+		"c": {{Address: "10.0.0.3:80"}},
+	})
+	shrunk := map[string][]Endpoint{"a": {{Address: "10.0.0.1:80"}}}
+	if registry.UpdateWatch(providerConsul, shrunk) {
+		t.Fatal("shrunk catalog applied without being held")
+	}
+	if registry.UpdateWatch(providerConsul, shrunk) {
+		t.Fatal("shrunk catalog applied before the hold time")
+	}
+
+	// a watch update applies the shrunk catalog once held for the hold time, no full sync needed
+	registry.Guard.since[providerConsul] = time.Now().Add(-time.Minute)
+	if !registry.UpdateWatch(providerConsul, shrunk) {
+		t.Fatal("shrunk catalog still held after the hold time")
+	}
+	if _, err := registry.Lookup("b"); err == nil {
+		t.Fatal("service b is still routed")
+	}
+	if _, ok := registry.Guard.since[providerConsul]; ok {
+		t.Fatal("guard still holds the applied provider")
+	}
+}
+
+func TestNewRegistryGuard(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    *Config
+		providers []string
+		enabled   bool
+		fails     bool
+	}{
+		{name: "disabled", config: &Config{GuardSyncs: 0}, providers: []string{providerConsul}},
+		{name: "consul", config: &Config{GuardSyncs: 3, GuardHold: 120, ResyncInterval: 300}, providers: []string{providerConsul}, enabled: true},
+		{name: "consul without resync", config: &Config{GuardSyncs: 3, ResyncInterval: 0}, providers: []string{providerFile, providerConsul}, fails: true},
+		{name: "file without resync", config: &Config{GuardSyncs: 3, ResyncInterval: 0}, providers: []string{providerFile}, enabled: true},
+		{name: "negative hold", config: &Config{GuardSyncs: 3, GuardHold: -1, ResyncInterval: 300}, providers: []string{providerConsul}, fails: true},
+	}
+	for _, tt := range tests {
+		guard, err := NewRegistryGuard(tt.config, tt.providers)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (guard != nil) != tt.enabled {
+			t.Errorf("%s: guard enabled %v, want %v", tt.name, guard != nil, tt.enabled)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+// health policies, they decide how instances with warning checks are routed
+const (
+	healthPassing  = "passing"
+	healthWarning  = "warning"
+	healthWeighted = "weighted"
+)
+
+// defaultWeight is the routing weight of a passing instance
+const defaultWeight = 100
+
+// Consul maintenance mode check IDs
+const (
+	nodeMaintenanceCheck    = "_node_maintenance"
+	serviceMaintenanceCheck = "_service_maintenance:"
+)
+
+// HealthPolicy computes the routing weight of a service instance from its Consul checks.
+// Instances in node or service maintenance are never routed, whatever the policy.
+type HealthPolicy struct {
+	Policy        string
+	WarningWeight int
+	Ignore        map[string]bool
+}
+
+// NewHealthPolicy creates the default health policy from config,
+// services can override it with the goc.health tag
+func NewHealthPolicy(config *Config) (*HealthPolicy, error) {
+	if !validHealthPolicy(config.HealthPolicy) {
+		return nil, fmt.Errorf("unknown health policy %s", config.HealthPolicy)
+	}
+	if config.HealthWarningWeight < 1 || config.HealthWarningWeight > defaultWeight {
+		return nil, fmt.Errorf("HealthWarningWeight must be between 1 and %v", defaultWeight)
+	}
+	ignore := make(map[string]bool)
+	for _, id := range strings.Split(config.HealthIgnoreChecks, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ignore[id] = true
+		}
+	}
+	return &HealthPolicy{
+		Policy:        config.HealthPolicy,
+		WarningWeight: config.HealthWarningWeight,
+		Ignore:        ignore,
+	}, nil
+}
+
+// Weight returns the routing weight of an instance and, when it is not routed, the reason
+func (h *HealthPolicy) Weight(tags []string, checks []*consul_api.HealthCheck) (int, string) {
+	warning := false
+	for _, check := range checks {
+		if check.CheckID == nodeMaintenanceCheck || strings.HasPrefix(check.CheckID, serviceMaintenanceCheck) {
+			return 0, "maintenance"
+		}
+		if h.Ignore[check.CheckID] {
+			continue
+		}
+		switch check.Status {
+		case consul_api.HealthCritical:
+			return 0, "critical"
+		case consul_api.HealthWarning:
+			warning = true
+		}
+	}
+	if !warning {
+		return defaultWeight, ""
+	}
+
+	policy := h.Policy
+	if p, ok := tagValue(tags, tagHealth); ok && validHealthPolicy(p) {
+		policy = p
+	}
+	switch policy {
+	case healthPassing:
+		return 0, "warning"
+	case healthWeighted:
+		return h.WarningWeight, ""
+	}
+	return defaultWeight, ""
+}
+
+func validHealthPolicy(policy string) bool {
+	switch policy {
+	case healthPassing, healthWarning, healthWeighted:
+		return true
+	}
+	return false
+}
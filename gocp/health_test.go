@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+func TestHealthPolicyWeight(t *testing.T) {
+	passing := &consul_api.HealthCheck{CheckID: "serfHealth", Status: consul_api.HealthPassing}
+	warning := &consul_api.HealthCheck{CheckID: "service:web", Status: consul_api.HealthWarning}
+	critical := &consul_api.HealthCheck{CheckID: "service:web", Status: consul_api.HealthCritical}
+	tests := []struct {
+		name   string
+		policy string
+		ignore string
+		tags   []string
+		checks []*consul_api.HealthCheck
+		weight int
+		reason string
+	}{
+		{name: "passing", policy: healthPassing, checks: []*consul_api.HealthCheck{passing}, weight: defaultWeight},
+		{name: "no checks", policy: healthPassing, weight: defaultWeight},
+		{name: "critical", policy: healthWarning, checks: []*consul_api.HealthCheck{passing, critical}, reason: "critical"},
+		{name: "warning on passing policy", policy: healthPassing, checks: []*consul_api.HealthCheck{warning}, reason: "warning"},
+		{name: "warning on warning policy", policy: healthWarning, checks: []*consul_api.HealthCheck{warning}, weight: defaultWeight},
+		{name: "warning on weighted policy", policy: healthWeighted, checks: []*consul_api.HealthCheck{warning}, weight: 10},
+		{name: "tag overrides policy", policy: healthPassing, tags: []string{"goc.health=weighted"}, checks: []*consul_api.HealthCheck{warning}, weight: 10},
+		{name: "invalid tag ignored", policy: healthPassing, tags: []string{"goc.health=some"}, checks: []*consul_api.HealthCheck{warning}, reason: "warning"},
+		{name: "ignored critical check", policy: healthPassing, ignore: "service:web", checks: []*consul_api.HealthCheck{passing, critical}, weight: defaultWeight},
+		{name: "node maintenance", policy: healthWarning, ignore: nodeMaintenanceCheck,
+			checks: []*consul_api.HealthCheck{{CheckID: nodeMaintenanceCheck, Status: consul_api.HealthCritical}}, reason: "maintenance"},
+		{name: "service maintenance", policy: healthWarning,
+			checks: []*consul_api.HealthCheck{{CheckID: serviceMaintenanceCheck + "web-1", Status: consul_api.HealthCritical}}, reason: "maintenance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewHealthPolicy(&Config{HealthPolicy: tt.policy, HealthWarningWeight: 10, HealthIgnoreChecks: tt.ignore})
+			if err != nil {
+				t.Fatal(err)
+			}
+			weight, reason := policy.Weight(tt.tags, tt.checks)
+			if weight != tt.weight || reason != tt.reason {
+				t.Errorf("weight %v reason %q, want %v %q", weight, reason, tt.weight, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNewHealthPolicyErrors(t *testing.T) {
+	tests := []*Config{
+		{HealthPolicy: "some", HealthWarningWeight: 10},
+		{HealthPolicy: healthWeighted, HealthWarningWeight: 0},
+		{HealthPolicy: healthWeighted, HealthWarningWeight: defaultWeight + 1},
+	}
+	for _, config := range tests {
+		if _, err := NewHealthPolicy(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,33 +17,253 @@ func main() {
 	flag.StringVar(&config.LogLevel, "LogLevel", "debug", "logging threshold level: debug|info|warn|error|fatal|panic")
 	flag.IntVar(&config.Port, "Port", 8000, "HTTP port to listen on")
 	flag.StringVar(&config.ElectionKeyPrefix, "ElectionKeyPrefix", "leader/election/", "format: namespace/action/")
-	flag.StringVar(&config.HttpScheme, "HttpScheme", "http", "proxy scheme: http or https")
+	flag.StringVar(&config.ConsulAddress, "ConsulAddress", "", "Consul agent host:port, defaults to CONSUL_HTTP_ADDR or 127.0.0.1:8500")
+	flag.StringVar(&config.ConsulScheme, "ConsulScheme", "", "Consul agent scheme: http or https, defaults to https when Consul TLS files are set")
+	flag.StringVar(&config.ConsulDatacenter, "ConsulDatacenter", "", "Consul datacenter, defaults to the agent datacenter")
+	flag.StringVar(&config.ConsulToken, "ConsulToken", "", "Consul ACL token, defaults to CONSUL_HTTP_TOKEN")
+	flag.StringVar(&config.ConsulTokenFile, "ConsulTokenFile", "", "file holding the Consul ACL token")
+	flag.StringVar(&config.ConsulCAFile, "ConsulCAFile", "", "CA certificate used to verify the Consul agent")
+	flag.StringVar(&config.ConsulCertFile, "ConsulCertFile", "", "client certificate presented to the Consul agent")
+	flag.StringVar(&config.ConsulKeyFile, "ConsulKeyFile", "", "client certificate key presented to the Consul agent")
+	flag.StringVar(&config.HttpScheme, "HttpScheme", "http", "default proxy scheme: http or https, can be overridden per service with the goc.scheme tag or meta")
+	flag.StringVar(&config.UpstreamTLSDir, "UpstreamTLSDir", "", "directory used to resolve relative CA, cert and key paths set with goc.tls.* service tags")
 	flag.IntVar(&config.MaxIdleConnsPerHost, "MaxIdleConnsPerHost", 500, "proxy max idle connections per host")
-	flag.BoolVar(&config.DisableKeepAlives, "DisableKeepAlives", true, "proxy disable KeepAlive")
+	flag.BoolVar(&config.DisableKeepAlives, "DisableKeepAlives", false, "proxy disable KeepAlive")
+	flag.IntVar(&config.IdleConnTimeout, "IdleConnTimeout", 90, "seconds an idle upstream connection is kept in the service pool")
 	flag.StringVar(&config.Domain, "Domain", "", "if no domain is specified the default routing will be {proxyIP}:{proxyPort}/{serviceName}. If a domain is specified the routing will be {serviceName}.{domain}")
 	flag.StringVar(&config.Node, "Nonde", "goc-proxy-node1", "cluster node name")
 	flag.StringVar(&config.Cluster, "Cluster", "goc-proxy-cluster1", "cluster name")
+	flag.BoolVar(&config.Connect, "Connect", false, "enable Consul Connect mTLS and intentions for Connect enabled services")
+	flag.StringVar(&config.ConnectService, "ConnectService", "goc-proxy", "Consul Connect service name used to request the proxy leaf certificate")
+	flag.StringVar(&config.ConnectCallerHeader, "ConnectCallerHeader", "", "request header holding the caller service name checked against intentions, accepted from ConnectCallerTrustedCIDRs only, defaults to ConnectService")
+	flag.StringVar(&config.ConnectCallerTrustedCIDRs, "ConnectCallerTrustedCIDRs", "", "comma separated list of client CIDRs allowed to set the ConnectCallerHeader, it is ignored from other clients")
+	flag.BoolVar(&config.ProxyProtocol, "ProxyProtocol", false, "accept PROXY protocol v1 and v2 headers from trusted sources")
+	flag.StringVar(&config.ProxyProtocolTrustedCIDRs, "ProxyProtocolTrustedCIDRs", "", "comma separated list of CIDRs allowed to send PROXY protocol headers, their connections without a valid header are rejected")
+	flag.IntVar(&config.ResyncInterval, "ResyncInterval", 300, "seconds between full Consul catalog resyncs, 0 disables the periodic resync")
+	flag.IntVar(&config.SyncDebounce, "SyncDebounce", 250, "milliseconds to wait for more service changes before updating the registry")
+	flag.StringVar(&config.HealthPolicy, "HealthPolicy", healthWarning, "routing of instances with warning checks: passing excludes them, warning routes them, weighted routes them with HealthWarningWeight. Overridden per service with the goc.health tag")
+	flag.IntVar(&config.HealthWarningWeight, "HealthWarningWeight", 25, "routing weight of warning instances with the weighted health policy, passing instances weight 100")
+	flag.StringVar(&config.HealthIgnoreChecks, "HealthIgnoreChecks", "", "comma separated list of Consul check IDs ignored when routing, maintenance checks can't be ignored")
+	flag.StringVar(&config.ExposeMode, "ExposeMode", exposeAll, "Consul services exposure: all services or only tagged ones with ExposeTag")
+	flag.StringVar(&config.ExposeTag, "ExposeTag", tagExpose, "Consul tag that exposes a service in tagged mode, the tag set to false hides a service in any mode")
+	flag.StringVar(&config.ExposeInclude, "ExposeInclude", "", "comma separated list of service name globs or re:regexps exposed, in all mode only these services are exposed")
+	flag.StringVar(&config.ExposeExclude, "ExposeExclude", "*goc-proxy*", "comma separated list of service name globs or re:regexps never exposed")
+	flag.StringVar(&config.Providers, "Providers", "consul", "comma separated list of service providers in precedence order: consul, file, dns")
+	flag.StringVar(&config.ProviderFile, "ProviderFile", "", "YAML or JSON file with static services used by the file provider")
+	flag.IntVar(&config.ProviderFileInterval, "ProviderFileInterval", 5, "seconds between file provider change checks")
+	flag.StringVar(&config.DNSServices, "DNSServices", "", "comma separated list of service=SRV record used by the dns provider, e.g. alpha=_http._tcp.alpha.example.com")
+	flag.StringVar(&config.DNSResolver, "DNSResolver", "", "DNS server host:port used by the dns provider, defaults to the system resolver")
+	flag.IntVar(&config.DNSInterval, "DNSInterval", 30, "seconds between dns provider SRV lookups")
+	flag.IntVar(&config.GuardMaxServiceLoss, "GuardMaxServiceLoss", 50, "maximum percent of services a registry update can remove before the guard holds it")
+	flag.IntVar(&config.GuardMaxEndpointLoss, "GuardMaxEndpointLoss", 50, "maximum percent of endpoints a registry update can remove before the guard holds it")
+	flag.IntVar(&config.GuardSyncs, "GuardSyncs", 3, "number of consecutive full syncs of a provider, every ResyncInterval for Consul, a held registry update must persist before being applied, 0 disables the guard")
+	flag.IntVar(&config.GuardHold, "GuardHold", 120, "seconds after which a held registry update is applied by the next update of its provider, whatever the GuardSyncs count, 0 only counts the full syncs")
+	flag.StringVar(&config.RegistryCacheFile, "RegistryCacheFile", "", "file where the registry is saved after each change and loaded at startup, empty disables the cache")
+	flag.StringVar(&config.AliasFile, "AliasFile", "", "YAML or JSON file mapping service aliases to services")
+	flag.IntVar(&config.AliasFileInterval, "AliasFileInterval", 5, "seconds between alias file change checks")
+	flag.StringVar(&config.AliasKVKey, "AliasKVKey", "", "Consul KV key holding the YAML or JSON alias table, exclusive with AliasFile")
+	flag.StringVar(&config.AliasCallerHeader, "AliasCallerHeader", "User-Agent", "request header identifying the caller of a service alias in metrics")
+	flag.StringVar(&config.AliasCallers, "AliasCallers", "", "comma separated list of callers labeled in the alias metrics, matched on the AliasCallerHeader value or its product token, other callers are labeled other")
+	flag.StringVar(&config.RouteFile, "RouteFile", "", "YAML or JSON route table file, requests matching no route fall back to path or domain routing")
+	flag.IntVar(&config.RouteFileInterval, "RouteFileInterval", 5, "seconds between route file change checks")
+	flag.StringVar(&config.RouteKVKey, "RouteKVKey", "", "Consul KV key holding the YAML or JSON route table, exclusive with RouteFile")
+	flag.StringVar(&config.ErrorTemplates, "ErrorTemplates", "", "comma separated list of media-type=template-file used for error responses by Accept header, defaults to application/problem+json")
+	flag.IntVar(&config.WrongHostStatus, "WrongHostStatus", http.StatusMisdirectedRequest, "status returned for hosts outside Domain: 400 or 421")
+	flag.StringVar(&config.RequestIDHeader, "RequestIDHeader", "X-Request-ID", "header holding the request ID accepted from callers, forwarded upstream and returned in responses")
+	flag.StringVar(&config.RequestIDPattern, "RequestIDPattern", `^[A-Za-z0-9._:+/=-]{1,128}$`, "regexp validating the caller request IDs, invalid IDs are replaced, empty accepts any ID")
+	flag.StringVar(&config.TracingExporter, "TracingExporter", "", "span exporter: otlp or zipkin, empty disables tracing")
+	flag.StringVar(&config.TracingEndpoint, "TracingEndpoint", "", "collector URL, e.g. http://localhost:4318/v1/traces for otlp or http://localhost:9411/api/v2/spans for zipkin")
+	flag.StringVar(&config.TracingServiceName, "TracingServiceName", "goc-proxy", "service name of the proxy spans and of the metrics pushed to OTLP")
+	flag.Float64Var(&config.TracingSampleRate, "TracingSampleRate", 1, "share of new traces sampled, between 0 and 1, traces started by callers keep their sampling decision")
+	flag.StringVar(&config.TracingPropagation, "TracingPropagation", "w3c,b3", "comma separated list of trace context formats injected in upstream requests: w3c, b3")
+	flag.StringVar(&config.AccessLog, "AccessLog", "", "access log destination: stdout or a file path, empty disables the access log")
+	flag.StringVar(&config.AccessLogFormat, "AccessLogFormat", "json", "access log format: json, common, combined or template")
+	flag.StringVar(&config.AccessLogTemplate, "AccessLogTemplate", "", "Go template of the access log lines in template format, e.g. {{.Method}} {{.URI}} {{.Status}} {{.Duration}}")
+	flag.IntVar(&config.AccessLogMaxSize, "AccessLogMaxSize", 100, "megabytes after which the access log file is rotated, 0 disables size rotation")
+	flag.IntVar(&config.AccessLogRotateInterval, "AccessLogRotateInterval", 24, "hours after which the access log file is rotated, 0 disables time rotation")
+	flag.IntVar(&config.AccessLogMaxBackups, "AccessLogMaxBackups", 7, "number of rotated access log files kept, 0 keeps all")
+	flag.StringVar(&config.AccessLogSampling, "AccessLogSampling", "", "comma separated list of service=rate logged share of requests, * sets the default, e.g. noisy=0.1,*=1")
+	flag.StringVar(&config.AccessLogStatus, "AccessLogStatus", "", "comma separated list of service=statuses logged, statuses are classes, codes or ranges joined with +, e.g. noisy=5xx,*=4xx+5xx")
+	flag.StringVar(&config.MetricsLatencyBuckets, "MetricsLatencyBuckets", "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10", "comma separated upstream duration and time to first byte histogram buckets in seconds")
+	flag.StringVar(&config.MetricsSizeBuckets, "MetricsSizeBuckets", "100,1000,10000,100000,1000000,10000000", "comma separated request and response size histogram buckets in bytes")
+	flag.BoolVar(&config.MetricsMethodLabel, "MetricsMethodLabel", false, "label the upstream metrics with the request method")
+	flag.BoolVar(&config.MetricsStatusClassLabel, "MetricsStatusClassLabel", false, "label the upstream duration histograms with the status class, 2xx to 5xx or error")
+	flag.BoolVar(&config.MetricsLegacy, "MetricsLegacy", true, "keep exposing the roundtrips_total and roundtrips_latency series during the migration to the histograms")
+	flag.StringVar(&config.SDFile, "SDFile", "", "Prometheus file_sd JSON file written after each registry change, empty disables the file")
+	flag.StringVar(&config.SDTag, "SDTag", "", "only expose the endpoints having this tag as Prometheus targets, e.g. metrics")
+	flag.StringVar(&config.StatsDAddress, "StatsDAddress", "", "StatsD host:port the metrics are pushed to over UDP, empty disables StatsD")
+	flag.StringVar(&config.StatsDFlavor, "StatsDFlavor", statsdPlain, "StatsD protocol: statsd, labels appended to the names, or dogstatsd, labels sent as tags")
+	flag.StringVar(&config.MetricsOTLPEndpoint, "MetricsOTLPEndpoint", "", "OTLP metrics receiver URL, e.g. http://localhost:4318/v1/metrics, empty disables the OTLP push")
+	flag.IntVar(&config.MetricsPushInterval, "MetricsPushInterval", 10, "seconds between StatsD and OTLP metrics pushes")
+	flag.StringVar(&config.MetricsPushPrefix, "MetricsPushPrefix", "goc.proxy.", "prefix of the pushed metric names")
+	flag.Float64Var(&config.AlertErrorRate, "AlertErrorRate", 0.05, "share of failed round trips of a service without SLO firing the generated error rate alert, can be overridden per service with the goc.alert.errorrate tag")
+	flag.StringVar(&config.AlertWindow, "AlertWindow", "5m", "rate window and pending period of the generated alerts, a Prometheus duration")
+	flag.StringVar(&config.GenerateFrom, "GenerateFrom", "", "URL of the goc-proxy whose registry is read by the generate subcommand, defaults to the local Port")
+	flag.StringVar(&config.SLOFile, "SLOFile", "", "YAML or JSON file with the SLO definitions, reloaded on change")
+	flag.IntVar(&config.SLOFileInterval, "SLOFileInterval", 5, "seconds between SLO file change checks")
+	flag.StringVar(&config.SLOKVKey, "SLOKVKey", "", "Consul KV key holding the SLO definitions, watched for changes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [generate dashboard|rules]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	setLogLevel(config.LogLevel)
 
-	leadershipElection, err := NewLeadershipElection(config)
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "generate" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := runGenerate(config, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if config.WrongHostStatus != http.StatusBadRequest && config.WrongHostStatus != http.StatusMisdirectedRequest {
+		log.Fatalf("WrongHostStatus must be %v or %v", http.StatusBadRequest, http.StatusMisdirectedRequest)
+	}
+
+	consulClient, consulConfig, err := newConsulClient(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	leadershipElection, err := NewLeadershipElection(config, consulClient, consulConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	registrySync, err := NewRegistrySync()
+	providers, err := parseProviders(config.Providers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registry := NewRegistry(providers)
+	registry.Guard, err = NewRegistryGuard(config, providers)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var reverseProxy = &ReverseProxy{
-		Config:   config,
-		Registry: registrySync.Registry,
+	registrySync, err := NewRegistrySync(config, registry, consulClient, consulConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	workers := []Worker{leadershipElection}
+
+	if config.RegistryCacheFile != "" {
+		registryCache := NewRegistryCache(config.RegistryCacheFile, registry)
+		if err := registryCache.Load(); err != nil {
+			log.Warnf("Registry cache not loaded: %s", err.Error())
+		}
+		workers = append(workers, registryCache)
+	}
+	for _, name := range providers {
+		var provider Provider
+		switch name {
+		case providerConsul:
+			provider = registrySync
+		case providerFile:
+			provider = NewFileProvider(config, registry)
+		case providerDNS:
+			provider, err = NewDNSProvider(config, registry)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		workers = append(workers, provider)
+		log.Infof("Service provider %s enabled", provider.Name())
+	}
+
+	var connectAgent *ConnectAgent
+	if config.Connect {
+		connectAgent, err = NewConnectAgent(config, consulClient, consulConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		workers = append(workers, connectAgent)
+	}
+
+	aliasTable, err := NewAliasTable(config, consulClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if aliasTable != nil {
+		workers = append(workers, aliasTable)
+	}
+
+	routeTable, err := NewRouteTable(config, consulClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if routeTable != nil {
+		workers = append(workers, routeTable)
+	}
+
+	errorPages, err := NewErrorPages(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	requestIDs, err := NewRequestIDs(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tracer, err := NewTracer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if sdFile := NewSDFile(config, registry); sdFile != nil {
+		workers = append(workers, sdFile)
+	}
+
+	accessLog, err := NewAccessLog(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	roundTripMetrics, err := NewRoundTripMetrics(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sloTable, err := NewSLOTable(config, consulClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sloTable != nil {
+		roundTripMetrics.SLOs = sloTable
+		workers = append(workers, sloTable)
+	}
+
+	generator, err := NewGenerator(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reverseProxy := NewReverseProxy(config, registry, connectAgent, aliasTable, routeTable, errorPages, requestIDs, tracer, accessLog, roundTripMetrics, generator)
+	workers = append(workers, reverseProxy)
+
+	metricsPusher, err := NewMetricsPusher(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the tracer, the access log and the metrics pusher are stopped after the proxy to write the last requests
+	if tracer != nil {
+		workers = append(workers, tracer)
+	}
+	if accessLog != nil {
+		workers = append(workers, accessLog)
+	}
+	if metricsPusher != nil {
+		workers = append(workers, metricsPusher)
 	}
 
 	// start background workers
-	startWorkers(leadershipElection, registrySync, reverseProxy)
+	startWorkers(workers...)
 
 	//wait for SIGINT (Ctrl+C) or SIGTERM (docker stop)
 	sigchan := make(chan os.Signal, 1)
@@ -49,7 +271,7 @@ func main() {
 	<-sigchan
 	log.Info("Stopping background workers...")
 	// 10s window before docker kills the container
-	stopWorkers(leadershipElection, registrySync, reverseProxy)
+	stopWorkers(workers...)
 	log.Info("Graceful shutdown succeeded")
 }
 
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// proxy_roundtrips_total and proxy_roundtrips_latency are the legacy round trip series,
+// replaced by the upstream histograms and exposed while MetricsLegacy is set
 var proxy_roundtrips_total = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Namespace: "goc",
@@ -34,9 +38,194 @@ var proxy_service_node_status = prometheus.NewGaugeVec(
 	[]string{"service", "node", "address"},
 )
 
-// exposes round trips total and latency for each service
-func registerMetrics() {
-	prometheus.MustRegister(proxy_roundtrips_total)
-	prometheus.MustRegister(proxy_roundtrips_latency)
+var proxy_connect_denied_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "connect_denied_total",
+		Help:      "The total number of requests denied by Consul Connect intentions, callers missing from the registry are labeled other.",
+	},
+	[]string{"service", "caller"},
+)
+
+var proxy_registry_guard_blocked_total = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "registry_guard_blocked_total",
+		Help:      "The total number of registry updates refused by the mass deregistration guard.",
+	},
+)
+
+var proxy_registry_guard_active = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "registry_guard_active",
+		Help:      "Mass deregistration guard status. Has two possible values: 1 - holding the last known good registry, 0 - inactive.",
+	},
+)
+
+var proxy_registry_stale_services = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "registry_stale_services",
+		Help:      "The number of services routed from the registry disk cache until the first provider sync.",
+	},
+)
+
+var proxy_alias_requests_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "alias_requests_total",
+		Help:      "Requests addressed to a service alias, by alias, target service and caller, callers missing from AliasCallers are labeled other.",
+	},
+	[]string{"alias", "service", "caller"},
+)
+
+var proxy_syncs_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "syncs_total",
+		Help:      "The total number of provider syncs, full or triggered by a watch.",
+	},
+	[]string{"provider", "type"},
+)
+
+var proxy_sync_duration_seconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "sync_duration_seconds",
+		Help:      "The duration of provider syncs, full or triggered by a watch.",
+		Buckets:   prometheus.DefBuckets,
+	},
+	[]string{"provider", "type"},
+)
+
+var proxy_sync_errors_total = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "sync_errors_total",
+		Help:      "The total number of provider sync errors by cause: unreachable, timeout, acl, server, invalid, io, lookup or other.",
+	},
+	[]string{"provider", "cause"},
+)
+
+var proxy_sync_last_success_timestamp_seconds = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "sync_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful provider sync or watch query, alert on time() minus this value.",
+	},
+	[]string{"provider"},
+)
+
+var proxy_sync_watchers = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "sync_watchers",
+		Help:      "The number of Consul service watchers running.",
+	},
+)
+
+var proxy_registry_services = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "registry_services",
+		Help:      "The number of services in the registry.",
+	},
+)
+
+var proxy_registry_endpoints = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "registry_endpoints",
+		Help:      "The number of service endpoints in the registry.",
+	},
+)
+
+var proxy_registry_changes_total = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "registry_changes_total",
+		Help:      "The total number of registry Sha changes published.",
+	},
+)
+
+var proxy_leader = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "leader",
+		Help:      "Leadership status of the proxy. Has two possible values: 1 - elected leader, 0 - follower.",
+	},
+)
+
+var proxy_leader_changes_total = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "goc",
+		Subsystem: "proxy",
+		Name:      "leader_changes_total",
+		Help:      "The total number of leadership acquisitions and losses of the proxy.",
+	},
+)
+
+// sync error causes
+const (
+	syncErrorUnreachable = "unreachable"
+	syncErrorTimeout     = "timeout"
+	syncErrorACL         = "acl"
+	syncErrorServer      = "server"
+	syncErrorInvalid     = "invalid"
+	syncErrorIO          = "io"
+	syncErrorLookup      = "lookup"
+	syncErrorOther       = "other"
+)
+
+// sync types
+const (
+	syncFull  = "full"
+	syncWatch = "watch"
+)
+
+// observeSync records a provider sync started at start, an empty cause stands for a successful sync
+func observeSync(provider string, syncType string, start time.Time, cause string) {
+	proxy_syncs_total.WithLabelValues(provider, syncType).Inc()
+	proxy_sync_duration_seconds.WithLabelValues(provider, syncType).Observe(time.Since(start).Seconds())
+	if cause != "" {
+		proxy_sync_errors_total.WithLabelValues(provider, cause).Inc()
+		return
+	}
+	proxy_sync_last_success_timestamp_seconds.WithLabelValues(provider).Set(float64(time.Now().Unix()))
+}
+
+// exposes the round trip metrics for each service and the registry metrics
+func registerMetrics(roundTrips *RoundTripMetrics) {
+	roundTrips.register()
 	prometheus.MustRegister(proxy_service_node_status)
+	prometheus.MustRegister(proxy_connect_denied_total)
+	prometheus.MustRegister(proxy_registry_guard_blocked_total)
+	prometheus.MustRegister(proxy_registry_guard_active)
+	prometheus.MustRegister(proxy_registry_stale_services)
+	prometheus.MustRegister(proxy_alias_requests_total)
+	prometheus.MustRegister(proxy_syncs_total)
+	prometheus.MustRegister(proxy_sync_duration_seconds)
+	prometheus.MustRegister(proxy_sync_errors_total)
+	prometheus.MustRegister(proxy_sync_last_success_timestamp_seconds)
+	prometheus.MustRegister(proxy_sync_watchers)
+	prometheus.MustRegister(proxy_registry_services)
+	prometheus.MustRegister(proxy_registry_endpoints)
+	prometheus.MustRegister(proxy_registry_changes_total)
+	prometheus.MustRegister(proxy_leader)
+	prometheus.MustRegister(proxy_leader_changes_total)
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Provider discovers services and feeds them to the registry
+// under its own name, the registry merges the providers catalogs
+type Provider interface {
+	Worker
+	Name() string
+}
+
+// known provider names
+const (
+	providerConsul = "consul"
+	providerFile   = "file"
+	providerDNS    = "dns"
+	// providerCache holds the registry loaded from disk at startup
+	providerCache = "cache"
+)
+
+// parseProviders validates the comma separated provider list,
+// the order of the list is the routing precedence
+func parseProviders(list string) ([]string, error) {
+	var providers []string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		switch p {
+		case providerConsul, providerFile, providerDNS:
+		default:
+			return nil, fmt.Errorf("unknown provider %s", p)
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("provider %s listed twice", p)
+		}
+		seen[p] = true
+		providers = append(providers, p)
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no provider configured")
+	}
+	return providers, nil
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
-	"strconv"
 	"strings"
 	"time"
 
@@ -18,34 +18,81 @@ import (
 
 // ReverseProxy holds the proxy configuration
 type ReverseProxy struct {
-	Config   *Config
-	Registry *Registry
+	Config     *Config
+	Registry   *Registry
+	Transports *TransportPool
+	Connect    *ConnectAgent
+	Aliases    *AliasTable
+	Routes     *RouteTable
+	Errors     *ErrorPages
+	RequestIDs *RequestIDs
+	Tracer     *Tracer
+	AccessLog  *AccessLog
+	Metrics    *RoundTripMetrics
+	Generator  *Generator
+	stopChan   chan struct{}
+	// doneChan is closed once the in-flight requests are drained
+	doneChan chan struct{}
+}
+
+// NewReverseProxy creates the HTTP reverse proxy with a transport pool
+func NewReverseProxy(config *Config, registry *Registry, connect *ConnectAgent, aliases *AliasTable, routes *RouteTable, errors *ErrorPages, requestIDs *RequestIDs, tracer *Tracer, accessLog *AccessLog, metrics *RoundTripMetrics, generator *Generator) *ReverseProxy {
+	return &ReverseProxy{
+		Config:     config,
+		Registry:   registry,
+		Transports: NewTransportPool(config, connect, errors, metrics),
+		Connect:    connect,
+		Aliases:    aliases,
+		Routes:     routes,
+		Errors:     errors,
+		RequestIDs: requestIDs,
+		Tracer:     tracer,
+		AccessLog:  accessLog,
+		Metrics:    metrics,
+		Generator:  generator,
+		stopChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}
 }
 
 // ProxyTransport is used to provide metrics and logging for round trips
 type ProxyTransport struct {
-	Service string
+	Service   string
+	Transport http.RoundTripper
+	Metrics   *RoundTripMetrics
 }
 
+type contextKey int
+
+const (
+	// clientAddrKey holds the client address in the upstream request context
+	clientAddrKey contextKey = iota
+	// endpointKey holds the selected endpoint address in the upstream request context
+	endpointKey
+	// prefixKey holds the path prefix rewrite reversed on the upstream response
+	prefixKey
+	// requestIDKey holds the request ID
+	requestIDKey
+	// spanKey holds the proxy trace span, parent of the upstream spans
+	spanKey
+)
+
 // Start the HTTP reverse proxy server
 func (r *ReverseProxy) Start() {
 
-	registerMetrics()
+	registerMetrics(r.Metrics)
 
 	render := unrender.New(unrender.Options{
 		IndentJSON: true,
 		Layout:     "layout",
 	})
 
-	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = r.Config.MaxIdleConnsPerHost
-	http.DefaultTransport.(*http.Transport).DisableKeepAlives = r.Config.DisableKeepAlives
-
 	http.HandleFunc("/", r.ReverseHandlerFunc())
 
 	http.Handle("/metrics", promhttp.Handler())
 
 	http.HandleFunc("/_/registry", func(w http.ResponseWriter, req *http.Request) {
-		render.JSON(w, http.StatusOK, r.Registry)
+		render.JSON(w, http.StatusOK, r.Registry.Snapshot())
 	})
 	http.HandleFunc("/_/ping", func(w http.ResponseWriter, req *http.Request) {
 		render.Text(w, http.StatusOK, "pong")
@@ -54,97 +101,348 @@ func (r *ReverseProxy) Start() {
 		render.JSON(w, http.StatusOK, Info())
 	})
 	http.HandleFunc("/_/config", func(w http.ResponseWriter, req *http.Request) {
-		render.JSON(w, http.StatusOK, r.Config)
+		render.JSON(w, http.StatusOK, r.Config.Redacted())
 	})
+	http.HandleFunc("/_/routes", func(w http.ResponseWriter, req *http.Request) {
+		render.JSON(w, http.StatusOK, r.Routes.Routes())
+	})
+	http.HandleFunc("/_/generate/dashboard", func(w http.ResponseWriter, req *http.Request) {
+		render.JSON(w, http.StatusOK, r.Generator.Dashboard(r.Registry.Snapshot()))
+	})
+	http.HandleFunc("/_/generate/rules", func(w http.ResponseWriter, req *http.Request) {
+		r.Generator.writeRules(w, r.Registry.Snapshot(), r.Metrics.SLOs.SLOs())
+	})
+	http.HandleFunc("/_/slo", func(w http.ResponseWriter, req *http.Request) {
+		render.JSON(w, http.StatusOK, r.Metrics.SLOs.Status())
+	})
+	http.HandleFunc("/_/sd", r.sdHandlerFunc(render))
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", r.Config.Port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if r.Config.ProxyProtocol {
+		trusted, err := parseCIDRs(r.Config.ProxyProtocolTrustedCIDRs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener = &ProxyProtoListener{
+			Listener: listener,
+			Trusted:  trusted,
+			Timeout:  5 * time.Second,
+		}
+		log.Infof("PROXY protocol enabled for %v", r.Config.ProxyProtocolTrustedCIDRs)
+	}
+
+	go r.pruneTransports(r.stopChan)
 
 	log.Infof("Starting server on port %v", r.Config.Port)
-	log.Fatal(manners.ListenAndServe(fmt.Sprintf(":%v", r.Config.Port), http.DefaultServeMux))
+	// Serve returns nil once Stop has drained the connections
+	if err := manners.Serve(listener, http.DefaultServeMux); err != nil {
+		log.Fatal(err)
+	}
+	close(r.doneChan)
 }
 
-// Stop attempts to gracefully shutdown the HTTP server
+// Stop attempts to gracefully shutdown the HTTP server, it returns once the
+// in-flight requests are served so the workers stopped next can record them
 func (r *ReverseProxy) Stop() {
+	close(r.stopChan)
 	manners.Close()
+	<-r.doneChan
 }
 
 // ReverseHandlerFunc creates a http handler that will resolve services from registry
 func (r *ReverseProxy) ReverseHandlerFunc() http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		service := ""
-		if r.Config.Domain == "" {
-			s, err := r.serviceFromURL(req.URL)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		req = r.RequestIDs.Handle(rw, req)
+		w := &statusWriter{ResponseWriter: rw}
+		req, span := r.Tracer.StartServer(req)
+		entry := r.accessEntry(req, span)
+		missing := false
+		defer func() {
+			span.Finish(w.Status(), nil)
+			// client cancellations do not spend the error budget
+			if entry.Service != "" && req.Context().Err() != context.Canceled {
+				r.Metrics.SLOs.Record(entry.Service, time.Since(start), missing || w.Status() >= 500)
 			}
-			service = s
-		} else {
-			s, err := r.serviceFromDomain(req.Host)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if r.AccessLog != nil {
+				entry.Status = w.Status()
+				entry.Bytes = w.bytes
+				entry.Duration = time.Since(start)
+				r.AccessLog.Log(entry)
+			}
+		}()
+
+		service, route, prefix, err := r.resolveService(req)
+		if err != nil {
+			status := http.StatusBadRequest
+			if r.Config.Domain != "" {
+				status = r.Config.WrongHostStatus
+			}
+			r.Errors.Write(w, req, status, "", err.Error())
+			return
+		}
+		var tags []string
+		var rewrite *PathRewrite
+		if route != nil {
+			tags = route.Tags
+			rewrite = route.Rewrite
+		}
+		if err := rewriteRequest(req, prefix, rewrite); err != nil {
+			r.Errors.Write(w, req, http.StatusBadRequest, service, err.Error())
+			return
+		}
+
+		//resolve service aliases, routes of the route table target services directly
+		if alias, ok := r.Aliases.Lookup(service); ok && route == nil {
+			proxy_alias_requests_total.WithLabelValues(service, alias.Service, r.Aliases.Caller(req)).Inc()
+			alias.SetHeaders(w.Header())
+			if alias.Redirect != 0 {
+				http.Redirect(w, req, r.aliasLocation(req, alias.Service), alias.Redirect)
 				return
 			}
-			service = s
+			service = alias.Service
 		}
 
-		//resolve service name address
-		endpoints, _ := r.Registry.Lookup(service)
+		span.SetService(service)
+		entry.Service = service
+
+		//resolve service name address, the route tags select a subset of the service endpoints
+		snapshot := r.Registry.Snapshot()
+		all, err := snapshot.Lookup(service)
+		if err != nil {
+			requestLog(req).Debugf("xproxy: service not found in registry %s", service)
+			missing = true
+			r.Errors.Write(w, req, http.StatusNotFound, service, err.Error())
+			return
+		}
+		all = connectEndpoints(all, r.Connect != nil)
+		endpoints := taggedEndpoints(all, tags)
 
 		if len(endpoints) == 0 {
-			log.Warnf("xproxy: service not found in registry %s", service)
+			requestLog(req).Warnf("xproxy: service %s has no available endpoints", service)
+			r.Errors.Write(w, req, http.StatusServiceUnavailable, service, fmt.Sprintf("service %s has no available endpoints", service))
 			return
 		}
 
-		//random load balancer
+		//check Connect intentions
+		if endpoints[0].Connect {
+			caller := r.Connect.Caller(req)
+			authorized, err := r.Connect.Authorize(caller, service)
+			if err != nil {
+				requestLog(req).Errorf("xproxy: Connect authorize error %s", err.Error())
+				r.Errors.Write(w, req, http.StatusBadGateway, service, "Consul Connect authorization failed")
+				return
+			}
+			if !authorized {
+				proxy_connect_denied_total.WithLabelValues(service, r.callerLabel(caller)).Inc()
+				r.Errors.Write(w, req, http.StatusForbidden, service, fmt.Sprintf("route from %s to %s denied by Consul intentions", caller, service))
+				return
+			}
+		}
+
+		//weighted random load balancer
 		//TODO: implement round robin
-		endpoint := endpoints[rand.Int()%len(endpoints)]
-		redirect, _ := url.ParseRequestURI(r.Config.HttpScheme + "://" + endpoint)
+		endpoint := pickEndpoint(endpoints)
+		entry.Upstream = endpoint.Address
+		settings := r.Transports.Settings(snapshot, service)
+
+		upstream, err := r.Transports.Get(service, settings)
+		if err != nil {
+			requestLog(req).Errorf("xproxy: %s", err.Error())
+			r.Errors.Write(w, req, http.StatusBadGateway, service, fmt.Sprintf("service %s transport is misconfigured", service))
+			return
+		}
 
-		rproxy := httputil.NewSingleHostReverseProxy(redirect)
-		rproxy.FlushInterval = 100 * time.Microsecond
-		rproxy.Transport = &ProxyTransport{
-			Service: service,
+		ctx := context.WithValue(req.Context(), endpointKey, endpoint.Address)
+		if settings.ProxyProtocol != "" {
+			ctx = context.WithValue(ctx, clientAddrKey, req.RemoteAddr)
+		}
+		if prefix != nil {
+			ctx = context.WithValue(ctx, prefixKey, prefix)
 		}
-		rproxy.ServeHTTP(w, req)
+		upstream.proxy.ServeHTTP(w, req.WithContext(ctx))
 	})
 }
 
+// pruneTransports drops the transports of the services removed from registry
+func (r *ReverseProxy) pruneTransports(stop <-chan struct{}) {
+	updates := r.Registry.Subscribe()
+	defer r.Registry.Unsubscribe(updates)
+	for {
+		select {
+		case <-stop:
+			return
+		case snapshot := <-updates:
+			r.Transports.Prune(func(service string) bool {
+				_, ok := snapshot.Catalog[service]
+				return ok
+			})
+		}
+	}
+}
+
 // RoundTrip records prometheus metrics. On debug, it logs the request URL, status code and duration.
 func (t *ProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	start := time.Now().UTC()
-	response, err := http.DefaultTransport.RoundTrip(req)
+	span := startClientSpan(req, t.Service)
+	rt := t.Metrics.start(t.Service, req)
+	response, err := t.Transport.RoundTrip(req)
 
-	if err == nil {
-		log.Debugf("Round trip to %v at %v, code: %v, duration: %v", t.Service, req.URL, response.StatusCode, time.Now().UTC().Sub(start))
-		proxy_roundtrips_total.WithLabelValues(t.Service, strconv.Itoa(response.StatusCode)).Inc()
-	} else {
-		// set status code 5000 for transport errors
-		proxy_roundtrips_total.WithLabelValues(t.Service, strconv.Itoa(5000)).Inc()
-		log.Warnf("Round trip error %s", err.Error())
+	if err != nil {
+		span.Finish(0, err)
+		rt.failed(req, err)
+		requestLog(req).Warnf("Round trip error %s", err.Error())
+		return nil, err
 	}
 
-	proxy_roundtrips_latency.WithLabelValues(t.Service).Observe(time.Since(start).Seconds())
+	span.Finish(response.StatusCode, nil)
+	rt.responded(response)
+	requestLog(req).Debugf("Round trip to %v at %v, code: %v, duration: %v", t.Service, req.URL, response.StatusCode, time.Now().UTC().Sub(start))
 
 	response.Header.Set("Server", "GOC-Proxy")
 	response.Header.Set("X-GOC-Proxy-Version", Version)
 
-	return response, err
+	return response, nil
+}
+
+// sdHandlerFunc serves the registry as Prometheus http_sd, the tag query parameter overrides the SDTag filter
+func (r *ReverseProxy) sdHandlerFunc(render *unrender.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		tag := r.Config.SDTag
+		if values, ok := req.URL.Query()["tag"]; ok {
+			tag = values[0]
+		}
+		render.JSON(w, http.StatusOK, sdTargets(r.Registry.Snapshot(), tag, r.Config.ConsulDatacenter))
+	}
+}
+
+// callerLabel bounds the caller label values to the registry services and the proxy itself
+func (r *ReverseProxy) callerLabel(caller string) string {
+	if caller == r.Config.ConnectService {
+		return caller
+	}
+	if _, err := r.Registry.Lookup(caller); err == nil {
+		return caller
+	}
+	return "other"
+}
+
+// accessEntry starts the access log record of the request as sent by the caller
+func (r *ReverseProxy) accessEntry(req *http.Request, span *Span) *AccessEntry {
+	if r.AccessLog == nil {
+		return &AccessEntry{}
+	}
+	entry := &AccessEntry{
+		Time:      time.Now(),
+		ClientIP:  clientIP(req.RemoteAddr),
+		Method:    req.Method,
+		URI:       req.RequestURI,
+		Proto:     req.Proto,
+		Host:      req.Host,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+		RequestID: requestIDFrom(req.Context()),
+	}
+	if span != nil {
+		entry.TraceID = span.TraceID
+	}
+	return entry
+}
+
+// statusWriter records the response status and size
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets the reverse proxy stream responses
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the server response writer to http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status returns the response status, 200 when nothing was written
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// resolveService returns the service of the first matching route, or the service
+// from the URL path or domain when no route matches, with the path prefix to rewrite
+func (r *ReverseProxy) resolveService(req *http.Request) (service string, route *Route, prefix *prefixRewrite, err error) {
+	if route, ok := r.Routes.Match(req); ok {
+		return route.Service, route, routePrefix(route), nil
+	}
+	if r.Config.Domain == "" {
+		service, err = r.serviceFromURL(req.URL)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		// the service name is stripped from the path
+		return service, nil, &prefixRewrite{From: "/" + url.PathEscape(service)}, nil
+	}
+	service, err = r.serviceFromDomain(req.Host)
+	return service, nil, nil, err
 }
 
 // extracts the service name from the URL: http://<proxy.com>/<service_name>/path/to
 func (r *ReverseProxy) serviceFromURL(target *url.URL) (name string, err error) {
-	path := target.Path
-	if len(path) > 1 && path[0] == '/' {
-		path = path[1:]
+	path := strings.TrimPrefix(target.EscapedPath(), "/")
+	segment := strings.SplitN(path, "/", 2)[0]
+	name, err = url.PathUnescape(segment)
+	if err != nil {
+		return "", fmt.Errorf("parse service name failed, invalid path %s", target.Path)
 	}
-	tmp := strings.Split(path, "/")
-	if len(tmp) < 1 {
-		return "", fmt.Errorf("parse service name failed, invalid path %s", path)
-	}
-	name = tmp[0]
-	target.Path = "/" + strings.Join(tmp[1:], "/")
 	return name, nil
 }
 
+// aliasLocation returns the request URL addressed to the service instead of its alias,
+// the request path must already be stripped from the service name
+func (r *ReverseProxy) aliasLocation(req *http.Request, service string) string {
+	location := &url.URL{
+		RawQuery: req.URL.RawQuery,
+	}
+	setEscapedPath(location, req.URL.EscapedPath())
+	if r.Config.Domain == "" {
+		setEscapedPath(location, "/"+url.PathEscape(service)+req.URL.EscapedPath())
+	} else {
+		// keep the caller scheme with a protocol relative URL
+		location.Host = service + "." + r.Config.Domain
+		if _, port, err := net.SplitHostPort(req.Host); err == nil {
+			location.Host = net.JoinHostPort(location.Host, port)
+		}
+	}
+	return location.String()
+}
+
 // extracts the service name from the domain: http://<service_name>.<proxy.com>/path/to
 func (r *ReverseProxy) serviceFromDomain(hostname string) (name string, err error) {
 	// strip port number from host name
@@ -152,8 +450,31 @@ func (r *ReverseProxy) serviceFromDomain(hostname string) (name string, err erro
 	domain := "." + r.Config.Domain
 	validDomain := strings.HasSuffix(path, domain)
 	if !validDomain {
-		return "", fmt.Errorf("invaid domain %s expected %s", path, r.Config.Domain)
+		return "", fmt.Errorf("invalid domain %s expected %s", path, r.Config.Domain)
 	}
 	name = strings.Replace(path, domain, "", 1)
 	return name, nil
 }
+
+// pickEndpoint selects a random endpoint proportionally to its weight,
+// endpoints without weight count as passing ones
+func pickEndpoint(endpoints []Endpoint) Endpoint {
+	total := 0
+	for _, e := range endpoints {
+		total += endpointWeight(e)
+	}
+	n := rand.Intn(total)
+	for _, e := range endpoints {
+		if n -= endpointWeight(e); n < 0 {
+			return e
+		}
+	}
+	return endpoints[len(endpoints)-1]
+}
+
+func endpointWeight(e Endpoint) int {
+	if e.Weight <= 0 {
+		return defaultWeight
+	}
+	return e.Weight
+}
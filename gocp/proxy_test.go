@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testReverseProxy routes the echo service to the backend with the default flag values
+func testReverseProxy(tb testing.TB, backend string, config *Config) *ReverseProxy {
+	target, err := url.Parse(backend)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if config == nil {
+		config = &Config{HttpScheme: "http", MaxIdleConnsPerHost: 500, IdleConnTimeout: 90}
+	}
+	config.RequestIDHeader = "X-Request-ID"
+	registry := NewRegistry([]string{providerFile})
+	registry.Update(providerFile, map[string][]Endpoint{
+		"echo": {{Address: target.Host, Tags: []string{"goc.scheme=http", "goc.tls.insecure"}}},
+	})
+	errors, err := NewErrorPages(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	requestIDs, err := NewRequestIDs(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return NewReverseProxy(config, registry, nil, nil, nil, errors, requestIDs, nil, nil, testRoundTripMetrics(tb), nil)
+}
+
+// BenchmarkReverseHandler measures a GET through the proxy handler to a local backend returning 4KB
+func BenchmarkReverseHandler(b *testing.B) {
+	body := strings.Repeat("x", 4096)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer backend.Close()
+	proxy := httptest.NewServer(testReverseProxy(b, backend.URL, nil).ReverseHandlerFunc())
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 100}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(proxy.URL + "/echo/")
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				b.Errorf("status %v, want 200", resp.StatusCode)
+				return
+			}
+		}
+	})
+}
+
+func TestReverseHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.URL.Path)
+	}))
+	defer backend.Close()
+	handler := testReverseProxy(t, backend.URL, nil).ReverseHandlerFunc()
+
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		{target: "/echo/a/b", status: http.StatusOK, body: "/a/b"},
+		{target: "/echo", status: http.StatusOK, body: "/"},
+		{target: "/missing/a", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s status %v, want %v", tt.target, w.Code, tt.status)
+			continue
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s body %q, want %q", tt.target, w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestTransportPoolSettings(t *testing.T) {
+	pool := NewTransportPool(&Config{HttpScheme: "http", UpstreamTLSDir: "/etc/tls"}, nil, nil, nil)
+	snapshot := &RegistrySnapshot{Catalog: map[string][]Endpoint{
+		"plain": {{Address: "10.0.0.1:80"}},
+		"tls": {
+			{Address: "10.0.0.2:443", Tags: []string{"goc.scheme=https", "goc.tls.ca=ca.pem"}},
+			{Address: "10.0.0.3:443", Tags: []string{"goc.tls.servername=tls.local", "goc.tls.insecure"}},
+		},
+		"meta":         {{Address: "10.0.0.4:443", Tags: []string{"goc.scheme=http"}, Meta: map[string]string{"goc.scheme": "https"}}},
+		"meta consul":  {{Address: "10.0.0.5:443", Meta: map[string]string{"goc_scheme": "https"}}},
+		"meta default": {{Address: "10.0.0.6:80", Tags: []string{"goc.scheme=https"}, Meta: map[string]string{"version": "1"}}},
+		"upper":        {{Address: "10.0.0.7:443", Tags: []string{"goc.scheme= HTTPS"}}},
+		"meta upper":   {{Address: "10.0.0.8:443", Meta: map[string]string{"goc.scheme": "Https"}}},
+		"invalid":      {{Address: "10.0.0.9:80", Tags: []string{"goc.scheme=ftp"}}},
+		"meta invalid": {{Address: "10.0.0.10:80", Tags: []string{"goc.scheme=https"}, Meta: map[string]string{"goc_scheme": "htps"}}},
+	}}
+	tests := []struct {
+		service  string
+		settings UpstreamSettings
+	}{
+		{service: "plain", settings: UpstreamSettings{Scheme: "http"}},
+		{service: "tls", settings: UpstreamSettings{Scheme: "https", CAFile: "/etc/tls/ca.pem", ServerName: "tls.local", InsecureSkipVerify: true}},
+		{service: "meta", settings: UpstreamSettings{Scheme: "https"}},
+		{service: "meta consul", settings: UpstreamSettings{Scheme: "https"}},
+		{service: "meta default", settings: UpstreamSettings{Scheme: "https"}},
+		{service: "upper", settings: UpstreamSettings{Scheme: "https"}},
+		{service: "meta upper", settings: UpstreamSettings{Scheme: "https"}},
+		{service: "invalid", settings: UpstreamSettings{Scheme: "http"}},
+		{service: "meta invalid", settings: UpstreamSettings{Scheme: "http"}},
+		{service: "missing", settings: UpstreamSettings{Scheme: "http"}},
+	}
+	for _, tt := range tests {
+		if got := pool.Settings(snapshot, tt.service); got != tt.settings {
+			t.Errorf("%s settings %+v, want %+v", tt.service, got, tt.settings)
+		}
+	}
+
+	// the settings are parsed once per snapshot
+	snapshot.Catalog["plain"] = []Endpoint{{Address: "10.0.0.1:80", Tags: []string{"goc.scheme=https"}}}
+	if got := pool.Settings(snapshot, "plain"); got.Scheme != "http" {
+		t.Errorf("settings parsed again, scheme %s", got.Scheme)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		pool.Settings(snapshot, "tls")
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per cached lookup", allocs)
+	}
+}
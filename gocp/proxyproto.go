@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoV2Sig is the PROXY protocol v2 header signature
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtoListener accepts PROXY protocol v1 and v2 headers
+// from trusted sources and exposes the real client address
+type ProxyProtoListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+	Timeout time.Duration
+}
+
+// Accept wraps connections from trusted sources, the header is read on first use
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtoConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.Timeout,
+	}, nil
+}
+
+func (l *ProxyProtoListener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.Trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a comma separated list of CIDRs
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	remoteAddr net.Addr
+	err        error
+	once       sync.Once
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the header every trusted source must send, a connection
+// without a valid header is rejected since its address could be taken for the client address
+func (c *proxyProtoConn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	// a timeout or a short read leaves an incomplete signature
+	sig, _ := c.reader.Peek(len(proxyProtoV2Sig))
+	switch {
+	case bytes.Equal(sig, proxyProtoV2Sig):
+		c.remoteAddr, c.err = readProxyProtoV2(c.reader)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		c.remoteAddr, c.err = readProxyProtoV1(c.reader)
+	default:
+		c.err = errors.New("missing header")
+	}
+	if c.err != nil {
+		c.err = fmt.Errorf("PROXY protocol error from %v: %v", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	// a v1 header is at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, errors.New("invalid v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("invalid v2 version")
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command, health checks from the load balancer itself
+	if command == 0 {
+		return nil, nil
+	}
+	switch family {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, errors.New("invalid v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, errors.New("invalid v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	// unsupported families are accepted without address information
+	return nil, nil
+}
+
+// writeProxyProtoHeader sends the PROXY protocol header for the client address on an upstream connection
+func writeProxyProtoHeader(conn net.Conn, version string, client string) error {
+	src, err := net.ResolveTCPAddr("tcp", client)
+	if err != nil {
+		return err
+	}
+	dst, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("upstream is not a TCP connection")
+	}
+
+	var header []byte
+	switch version {
+	case "v1":
+		proto, srcIP, dstIP := "TCP4", src.IP.String(), dst.IP.String()
+		if src.IP.To4() == nil || dst.IP.To4() == nil {
+			// mixed families are sent as IPv6 with IPv4-mapped addresses
+			proto, srcIP, dstIP = "TCP6", proxyProtoIPv6(src.IP), proxyProtoIPv6(dst.IP)
+		}
+		header = []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port))
+	case "v2":
+		buf := bytes.NewBuffer(proxyProtoV2Sig[:len(proxyProtoV2Sig):len(proxyProtoV2Sig)])
+		buf.WriteByte(0x21)
+		if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+			buf.Write([]byte{0x11, 0, 12})
+			buf.Write(src4)
+			buf.Write(dst4)
+		} else {
+			buf.Write([]byte{0x21, 0, 36})
+			buf.Write(src.IP.To16())
+			buf.Write(dst.IP.To16())
+		}
+		binary.Write(buf, binary.BigEndian, uint16(src.Port))
+		binary.Write(buf, binary.BigEndian, uint16(dst.Port))
+		header = buf.Bytes()
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %s", version)
+	}
+	_, err = conn.Write(header)
+	return err
+}
+
+// proxyProtoIPv6 formats an address in IPv6 notation, IPv4 addresses are IPv4-mapped
+func proxyProtoIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// proxyProtoDialer sends the PROXY protocol header after dialing the upstream
+func proxyProtoDialer(dialer *net.Dialer, version string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, ok := ctx.Value(clientAddrKey).(string)
+		if !ok {
+			return nil, errors.New("PROXY protocol client address missing from context")
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeProxyProtoHeader(conn, version, client); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
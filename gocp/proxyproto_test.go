@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyProtoV2Header builds a v2 header with the given command, family and address block
+func proxyProtoV2Header(command, family byte, payload []byte) []byte {
+	buf := bytes.NewBuffer(append([]byte(nil), proxyProtoV2Sig...))
+	buf.WriteByte(0x20 | command)
+	buf.WriteByte(family)
+	binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func TestReadProxyProtoV1(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+		fails  bool
+	}{
+		{name: "TCP4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 5000 80\r\n", addr: "192.0.2.1:5000"},
+		{name: "TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 5000 80\r\n", addr: "[2001:db8::1]:5000"},
+		{name: "IPv4-mapped", header: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 5000 80\r\n", addr: "192.0.2.1:5000"},
+		{name: "UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "UNKNOWN with addresses", header: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 5000 80\r\n"},
+		{name: "missing CR", header: "PROXY TCP4 192.0.2.1 198.51.100.1 5000 80\n", fails: true},
+		{name: "truncated", header: "PROXY TCP4 192.0.2.1 198.5", fails: true},
+		{name: "too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", fails: true},
+		{name: "missing fields", header: "PROXY TCP4 192.0.2.1 198.51.100.1 5000\r\n", fails: true},
+		{name: "unknown protocol", header: "PROXY UDP4 192.0.2.1 198.51.100.1 5000 80\r\n", fails: true},
+		{name: "invalid address", header: "PROXY TCP4 192.0.2 198.51.100.1 5000 80\r\n", fails: true},
+		{name: "invalid port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 port 80\r\n", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyProtoV1(bufio.NewReader(strings.NewReader(tt.header)))
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkProxyProtoAddr(t, addr, tt.addr)
+		})
+	}
+}
+
+func TestReadProxyProtoV2(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x13, 0x88, 0, 80}
+	ipv6 := append(append(append([]byte(nil), net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...), 0x13, 0x88, 0, 80)
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+		fails  bool
+	}{
+		{name: "IPv4", header: proxyProtoV2Header(1, 0x11, ipv4), addr: "192.0.2.1:5000"},
+		{name: "IPv6", header: proxyProtoV2Header(1, 0x21, ipv6), addr: "[2001:db8::1]:5000"},
+		{name: "IPv4 with TLVs", header: proxyProtoV2Header(1, 0x11, append(append([]byte(nil), ipv4...), 0x04, 0, 1, 0)), addr: "192.0.2.1:5000"},
+		{name: "LOCAL", header: proxyProtoV2Header(0, 0x00, nil)},
+		{name: "LOCAL with addresses", header: proxyProtoV2Header(0, 0x11, ipv4)},
+		{name: "unix family", header: proxyProtoV2Header(1, 0x31, make([]byte, 216))},
+		{name: "truncated header", header: proxyProtoV2Header(1, 0x11, ipv4)[:14], fails: true},
+		{name: "truncated payload", header: proxyProtoV2Header(1, 0x11, ipv4)[:20], fails: true},
+		{name: "short IPv4 block", header: proxyProtoV2Header(1, 0x11, ipv4[:8]), fails: true},
+		{name: "short IPv6 block", header: proxyProtoV2Header(1, 0x21, ipv4), fails: true},
+		{name: "invalid version", header: append(append(append([]byte(nil), proxyProtoV2Sig...), 0x11, 0x11, 0, 12), ipv4...), fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyProtoV2(bufio.NewReader(bytes.NewReader(tt.header)))
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkProxyProtoAddr(t, addr, tt.addr)
+		})
+	}
+}
+
+func TestProxyProtoConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		remote string
+		fails  bool
+	}{
+		{name: "v1", data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 80\r\nGET"), remote: "192.0.2.1:5000"},
+		{name: "v2", data: append(proxyProtoV2Header(1, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x13, 0x88, 0, 80}), "GET"...), remote: "192.0.2.1:5000"},
+		{name: "v2 LOCAL", data: append(proxyProtoV2Header(0, 0, nil), "GET"...), remote: "10.0.0.1:1234"},
+		{name: "no header", data: []byte("GET / HTTP/1.1\r\n"), remote: "10.0.0.1:1234", fails: true},
+		{name: "short read", data: []byte("PRO"), remote: "10.0.0.1:1234", fails: true},
+		{name: "empty", data: nil, remote: "10.0.0.1:1234", fails: true},
+		{name: "invalid header", data: []byte("PROXY TCP4 invalid\r\nGET"), remote: "10.0.0.1:1234", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &proxyProtoConn{
+				Conn:   &proxyProtoTestConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}},
+				reader: bufio.NewReader(bytes.NewReader(tt.data)),
+			}
+			if got := conn.RemoteAddr().String(); got != tt.remote {
+				t.Errorf("remote address %s, want %s", got, tt.remote)
+			}
+			b := make([]byte, 16)
+			n, err := conn.Read(b)
+			if tt.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b[:n]) != "GET" {
+				t.Errorf("read %q, want GET", b[:n])
+			}
+		})
+	}
+}
+
+func TestWriteProxyProtoHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		client  string
+		dst     string
+		header  string
+	}{
+		{name: "v1 IPv4", version: "v1", client: "192.0.2.1:5000", dst: "198.51.100.1:80",
+			header: "PROXY TCP4 192.0.2.1 198.51.100.1 5000 80\r\n"},
+		{name: "v1 IPv6", version: "v1", client: "[2001:db8::1]:5000", dst: "[2001:db8::2]:80",
+			header: "PROXY TCP6 2001:db8::1 2001:db8::2 5000 80\r\n"},
+		{name: "v1 IPv4 client to IPv6 upstream", version: "v1", client: "192.0.2.1:5000", dst: "[2001:db8::2]:80",
+			header: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 5000 80\r\n"},
+		{name: "v1 IPv6 client to IPv4 upstream", version: "v1", client: "[2001:db8::1]:5000", dst: "198.51.100.1:80",
+			header: "PROXY TCP6 2001:db8::1 ::ffff:198.51.100.1 5000 80\r\n"},
+		{name: "v2 IPv4", version: "v2", client: "192.0.2.1:5000", dst: "198.51.100.1:80"},
+		{name: "v2 IPv6", version: "v2", client: "[2001:db8::1]:5000", dst: "[2001:db8::2]:80"},
+		{name: "v2 mixed", version: "v2", client: "192.0.2.1:5000", dst: "[2001:db8::2]:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := net.ResolveTCPAddr("tcp", tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := &proxyProtoTestConn{remote: dst}
+			if err := writeProxyProtoHeader(conn, tt.version, tt.client); err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" && conn.written.String() != tt.header {
+				t.Errorf("header %q, want %q", conn.written.String(), tt.header)
+			}
+
+			// the header must parse back to the client address
+			reader := bufio.NewReader(&conn.written)
+			var addr net.Addr
+			if tt.version == "v1" {
+				addr, err = readProxyProtoV1(reader)
+			} else {
+				addr, err = readProxyProtoV2(reader)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkProxyProtoAddr(t, addr, tt.client)
+		})
+	}
+
+	if err := writeProxyProtoHeader(&proxyProtoTestConn{remote: &net.TCPAddr{}}, "v3", "192.0.2.1:5000"); err == nil {
+		t.Error("expected an error for an unsupported version")
+	}
+}
+
+func checkProxyProtoAddr(t *testing.T, addr net.Addr, want string) {
+	t.Helper()
+	if want == "" {
+		if addr != nil {
+			t.Errorf("address %v, want none", addr)
+		}
+		return
+	}
+	if addr == nil {
+		t.Fatalf("no address, want %s", want)
+	}
+	if addr.String() != want {
+		t.Errorf("address %v, want %s", addr, want)
+	}
+}
+
+// proxyProtoTestConn records writes and reports a fixed remote address
+type proxyProtoTestConn struct {
+	net.Conn
+	remote  net.Addr
+	written bytes.Buffer
+}
+
+func (c *proxyProtoTestConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyProtoTestConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		header  string
+		remote  string
+		served  bool
+	}{
+		{name: "trusted with header", trusted: "127.0.0.0/8", header: "PROXY TCP4 192.0.2.1 198.51.100.1 5000 80\r\n", remote: "192.0.2.1", served: true},
+		{name: "trusted without header", trusted: "127.0.0.0/8"},
+		{name: "untrusted without header", trusted: "10.0.0.0/8", remote: "127.0.0.1", served: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := parseCIDRs(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				host, _, _ := net.SplitHostPort(req.RemoteAddr)
+				io.WriteString(w, host)
+			})}
+			go server.Serve(&ProxyProtoListener{Listener: l, Trusted: trusted, Timeout: time.Second})
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, tt.header+"GET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if !tt.served {
+				// the HTTP server answers the header error with a 400 and closes the connection
+				if err == nil && resp.StatusCode != http.StatusBadRequest {
+					t.Fatalf("connection without header served with status %v", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tt.remote {
+				t.Errorf("remote address %s, want %s", body, tt.remote)
+			}
+		})
+	}
+}
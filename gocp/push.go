@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// StatsD flavors
+const (
+	statsdPlain = "statsd"
+	statsdDog   = "dogstatsd"
+)
+
+// statsdPacketSize keeps the datagrams under the usual network MTU
+const statsdPacketSize = 1432
+
+// MetricsPusher pushes the goc metrics gathered from the Prometheus registry to StatsD
+// and OTLP, so the pushed numbers are the ones scraped on /metrics.
+// StatsD receives the counter increments since the last flush, OTLP the cumulative values.
+type MetricsPusher struct {
+	Prefix       string
+	Interval     time.Duration
+	StatsD       string
+	Flavor       string
+	OTLPEndpoint string
+	ServiceName  string
+	Node         string
+	gatherer     prometheus.Gatherer
+	conn         net.Conn
+	client       *http.Client
+	// last pushed cumulative values of the StatsD counters
+	last     map[string]float64
+	start    time.Time
+	stopChan chan struct{}
+	done     chan struct{}
+}
+
+// NewMetricsPusher creates the push exporters from config, it returns nil when no exporter is configured
+func NewMetricsPusher(config *Config) (*MetricsPusher, error) {
+	if config.StatsDAddress == "" && config.MetricsOTLPEndpoint == "" {
+		return nil, nil
+	}
+	if config.MetricsPushInterval <= 0 {
+		return nil, fmt.Errorf("MetricsPushInterval must be positive")
+	}
+	p := &MetricsPusher{
+		Prefix:       config.MetricsPushPrefix,
+		Interval:     time.Duration(config.MetricsPushInterval) * time.Second,
+		StatsD:       config.StatsDAddress,
+		Flavor:       config.StatsDFlavor,
+		OTLPEndpoint: config.MetricsOTLPEndpoint,
+		ServiceName:  config.TracingServiceName,
+		Node:         config.Node,
+		gatherer:     prometheus.DefaultGatherer,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		last:         make(map[string]float64),
+		start:        time.Now(),
+		stopChan:     make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if p.StatsD != "" {
+		switch p.Flavor {
+		case statsdPlain, statsdDog:
+		default:
+			return nil, fmt.Errorf("unknown StatsD flavor %s", p.Flavor)
+		}
+		conn, err := net.Dial("udp", p.StatsD)
+		if err != nil {
+			return nil, fmt.Errorf("StatsDAddress: %v", err)
+		}
+		p.conn = conn
+	}
+	return p, nil
+}
+
+// Start pushes the metrics every interval
+func (p *MetricsPusher) Start() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.push()
+		case <-p.stopChan:
+			// push the requests served before shutdown
+			p.push()
+			return
+		}
+	}
+}
+
+// Stop pushes the last metrics and closes the StatsD socket
+func (p *MetricsPusher) Stop() {
+	close(p.stopChan)
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+func (p *MetricsPusher) push() {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		log.Warnf("Metrics gathering error %s", err.Error())
+	}
+	// only the goc metrics, the Go runtime and process collectors are left to the scrape
+	gocFamilies := families[:0]
+	for _, f := range families {
+		if strings.HasPrefix(f.GetName(), "goc_") {
+			gocFamilies = append(gocFamilies, f)
+		}
+	}
+	if p.conn != nil {
+		p.pushStatsD(gocFamilies)
+	}
+	if p.OTLPEndpoint != "" {
+		p.pushOTLP(gocFamilies)
+	}
+}
+
+// metricName maps goc_proxy_upstream_requests_total to <prefix>upstream_requests_total
+func (p *MetricsPusher) metricName(family *dto.MetricFamily) string {
+	return p.Prefix + strings.TrimPrefix(family.GetName(), "goc_proxy_")
+}
+
+// pushStatsD sends counters as increments since the last flush and gauges as values,
+// histograms and summaries are sent as .count and .sum counters and histograms
+// add a .bucket counter per upper bound
+func (p *MetricsPusher) pushStatsD(families []*dto.MetricFamily) {
+	var lines []string
+	counter := func(name string, labels []*dto.LabelPair, extra []string, value float64) {
+		line := p.statsdName(name, labels, extra)
+		delta := value - p.last[line]
+		if delta < 0 {
+			// the collector was reset
+			delta = value
+		}
+		p.last[line] = value
+		if delta != 0 {
+			lines = append(lines, p.statsdLine(name, labels, extra, formatFloat(delta), "c"))
+		}
+	}
+	gauge := func(name string, labels []*dto.LabelPair, value float64) {
+		if value < 0 {
+			// a signed StatsD gauge is an increment, reset it first
+			lines = append(lines, p.statsdLine(name, labels, nil, "0", "g"))
+		}
+		lines = append(lines, p.statsdLine(name, labels, nil, formatFloat(value), "g"))
+	}
+
+	for _, f := range families {
+		name := p.metricName(f)
+		for _, m := range f.GetMetric() {
+			labels := m.GetLabel()
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				counter(name, labels, nil, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				gauge(name, labels, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				gauge(name, labels, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				counter(name+".count", labels, nil, float64(h.GetSampleCount()))
+				counter(name+".sum", labels, nil, h.GetSampleSum())
+				for _, b := range h.GetBucket() {
+					counter(name+".bucket", labels, []string{"le", formatFloat(b.GetUpperBound())}, float64(b.GetCumulativeCount()))
+				}
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				counter(name+".count", labels, nil, float64(s.GetSampleCount()))
+				counter(name+".sum", labels, nil, s.GetSampleSum())
+			}
+		}
+	}
+	p.sendStatsD(lines)
+}
+
+// statsdName returns the metric name, with the labels appended as name segments for plain StatsD
+func (p *MetricsPusher) statsdName(name string, labels []*dto.LabelPair, extra []string) string {
+	pairs := labelPairs(labels, extra)
+	if p.Flavor == statsdDog {
+		return name + "|" + strings.Join(pairs, ",")
+	}
+	// label values are single name segments, e.g. upstream_requests_total.code_200.service_echo
+	for _, pair := range pairs {
+		name += "." + strings.NewReplacer(":", "_", ".", "_").Replace(pair)
+	}
+	return name
+}
+
+// statsdLine formats a metric line, DogStatsD labels are tags
+func (p *MetricsPusher) statsdLine(name string, labels []*dto.LabelPair, extra []string, value string, kind string) string {
+	if p.Flavor != statsdDog {
+		return p.statsdName(name, labels, extra) + ":" + value + "|" + kind
+	}
+	tags := labelPairs(labels, extra)
+	if p.Node != "" {
+		tags = append(tags, "node:"+statsdSanitize(p.Node))
+	}
+	line := name + ":" + value + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// sendStatsD packs the lines in datagrams
+func (p *MetricsPusher) sendStatsD(lines []string) {
+	var packet bytes.Buffer
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := p.conn.Write(packet.Bytes()); err != nil {
+			log.Warnf("StatsD push to %s error %s", p.StatsD, err.Error())
+		}
+		packet.Reset()
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	send()
+}
+
+// labelPairs returns the key:value pairs of the labels, extra holds additional key, value pairs
+func labelPairs(labels []*dto.LabelPair, extra []string) []string {
+	pairs := make([]string, 0, len(labels)+len(extra)/2)
+	for _, l := range labels {
+		pairs = append(pairs, statsdSanitize(l.GetName())+":"+statsdSanitize(l.GetValue()))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, statsdSanitize(extra[i])+":"+statsdSanitize(extra[i+1]))
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// statsdSanitize replaces the StatsD separators
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// pushOTLP sends an OTLP/HTTP JSON ExportMetricsServiceRequest with cumulative temporality
+func (p *MetricsPusher) pushOTLP(families []*dto.MetricFamily) {
+	start := strconv.FormatInt(p.start.UnixNano(), 10)
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	attributes := func(labels []*dto.LabelPair) []object {
+		attrs := make([]object, 0, len(labels))
+		for _, l := range labels {
+			attrs = append(attrs, object{"key": l.GetName(), "value": object{"stringValue": l.GetValue()}})
+		}
+		return attrs
+	}
+	point := func(m *dto.Metric) object {
+		return object{"attributes": attributes(m.GetLabel()), "startTimeUnixNano": start, "timeUnixNano": now}
+	}
+
+	metrics := make([]object, 0, len(families))
+	for _, f := range families {
+		var points []object
+		for _, m := range f.GetMetric() {
+			dp := point(m)
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				dp["asDouble"] = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				dp["asDouble"] = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				dp["asDouble"] = m.GetUntyped().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				// OTLP buckets are not cumulative and end with the +Inf bucket
+				var bounds []float64
+				var counts []string
+				var previous uint64
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					bounds = append(bounds, b.GetUpperBound())
+					counts = append(counts, strconv.FormatUint(b.GetCumulativeCount()-previous, 10))
+					previous = b.GetCumulativeCount()
+				}
+				counts = append(counts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+				dp["count"] = strconv.FormatUint(h.GetSampleCount(), 10)
+				dp["sum"] = h.GetSampleSum()
+				dp["explicitBounds"] = bounds
+				dp["bucketCounts"] = counts
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				quantiles := make([]object, 0, len(s.GetQuantile()))
+				for _, q := range s.GetQuantile() {
+					if !math.IsNaN(q.GetValue()) {
+						quantiles = append(quantiles, object{"quantile": q.GetQuantile(), "value": q.GetValue()})
+					}
+				}
+				dp["count"] = strconv.FormatUint(s.GetSampleCount(), 10)
+				dp["sum"] = s.GetSampleSum()
+				dp["quantileValues"] = quantiles
+			}
+			points = append(points, dp)
+		}
+
+		metric := object{"name": p.metricName(f), "description": f.GetHelp()}
+		switch f.GetType() {
+		case dto.MetricType_COUNTER:
+			metric["sum"] = object{"dataPoints": points, "aggregationTemporality": 2, "isMonotonic": true}
+		case dto.MetricType_HISTOGRAM:
+			metric["histogram"] = object{"dataPoints": points, "aggregationTemporality": 2}
+		case dto.MetricType_SUMMARY:
+			metric["summary"] = object{"dataPoints": points}
+		default:
+			metric["gauge"] = object{"dataPoints": points}
+		}
+		metrics = append(metrics, metric)
+	}
+
+	resource := []object{{"key": "service.name", "value": object{"stringValue": p.ServiceName}}}
+	if p.Node != "" {
+		resource = append(resource, object{"key": "service.instance.id", "value": object{"stringValue": p.Node}})
+	}
+	body, err := json.Marshal(object{
+		"resourceMetrics": []object{{
+			"resource": object{"attributes": resource},
+			"scopeMetrics": []object{{
+				"scope":   object{"name": "goc-proxy", "version": Version},
+				"metrics": metrics,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Errorf("OTLP metrics encoding error %s", err.Error())
+		return
+	}
+	resp, err := p.client.Post(p.OTLPEndpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("OTLP metrics push to %s error %s", p.OTLPEndpoint, err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warnf("OTLP metrics push to %s failed with status %v", p.OTLPEndpoint, resp.StatusCode)
+	}
+}
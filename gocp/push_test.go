@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testPushMetrics registers a goc counter, gauge, histogram and summary and a non goc counter
+type testPushMetrics struct {
+	registry  *prometheus.Registry
+	requests  *prometheus.CounterVec
+	inFlight  prometheus.Gauge
+	latency   *prometheus.HistogramVec
+	size      prometheus.Summary
+	goRuntime prometheus.Counter
+}
+
+func newTestPushMetrics(t *testing.T) *testPushMetrics {
+	m := &testPushMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "goc_proxy_requests_total", Help: "requests",
+		}, []string{"service", "code"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{Name: "goc_proxy_in_flight", Help: "in flight"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "goc_proxy_latency_seconds", Help: "latency", Buckets: []float64{0.1, 1},
+		}, []string{"service"}),
+		size:      prometheus.NewSummary(prometheus.SummaryOpts{Name: "goc_proxy_size_bytes", Help: "size"}),
+		goRuntime: prometheus.NewCounter(prometheus.CounterOpts{Name: "go_other_total", Help: "other"}),
+	}
+	m.registry.MustRegister(m.requests, m.inFlight, m.latency, m.size, m.goRuntime)
+	return m
+}
+
+// gathered returns the gathered value of a goc counter, gauge or histogram sample count by label values
+func (m *testPushMetrics) gathered(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			match := true
+			for _, l := range metric.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					match = false
+				}
+			}
+			if !match {
+				continue
+			}
+			switch {
+			case metric.Counter != nil:
+				return metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				return metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	t.Fatalf("metric %s %v not gathered", name, labels)
+	return 0
+}
+
+// statsdListener reads the datagrams pushed to a local UDP socket
+type statsdListener struct {
+	conn net.PacketConn
+}
+
+func newStatsDListener(t *testing.T) *statsdListener {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &statsdListener{conn: conn}
+}
+
+// packets returns the datagrams received until the socket is idle
+func (l *statsdListener) packets(t *testing.T) []string {
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+// lines returns the received StatsD lines by name and type, the value of repeated lines is the last one
+func (l *statsdListener) lines(t *testing.T) map[string]string {
+	lines := make(map[string]string)
+	for _, packet := range l.packets(t) {
+		for _, line := range strings.Split(packet, "\n") {
+			i := strings.Index(line, ":")
+			j := strings.Index(line, "|")
+			if i < 0 || j < i {
+				t.Fatalf("invalid StatsD line %q", line)
+			}
+			key := line[:i] + line[j:]
+			lines[key] = line[i+1 : j]
+		}
+	}
+	return lines
+}
+
+func testPusher(t *testing.T, m *testPushMetrics, config *Config) *MetricsPusher {
+	config.MetricsPushInterval = 10
+	pusher, err := NewMetricsPusher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pusher.gatherer = m.registry
+	t.Cleanup(func() {
+		if pusher.conn != nil {
+			pusher.conn.Close()
+		}
+	})
+	return pusher
+}
+
+func TestPushStatsD(t *testing.T) {
+	m := newTestPushMetrics(t)
+	listener := newStatsDListener(t)
+	pusher := testPusher(t, m, &Config{StatsDAddress: listener.conn.LocalAddr().String(), StatsDFlavor: statsdPlain, MetricsPushPrefix: "goc."})
+
+	m.requests.WithLabelValues("echo", "200").Add(3)
+	m.inFlight.Set(-2)
+	m.latency.WithLabelValues("echo").Observe(0.5)
+	m.latency.WithLabelValues("echo").Observe(2)
+	m.size.Observe(100)
+	m.goRuntime.Inc()
+	pusher.push()
+
+	lines := listener.lines(t)
+	want := map[string]float64{
+		"goc.requests_total.code_200.service_echo|c": m.gathered(t, "goc_proxy_requests_total", map[string]string{"service": "echo", "code": "200"}),
+		"goc.in_flight|g":                                  m.gathered(t, "goc_proxy_in_flight", nil),
+		"goc.latency_seconds.count.service_echo|c":         m.gathered(t, "goc_proxy_latency_seconds", map[string]string{"service": "echo"}),
+		"goc.latency_seconds.sum.service_echo|c":           2.5,
+		"goc.latency_seconds.bucket.le_0_1.service_echo|c": 0,
+		"goc.latency_seconds.bucket.le_1.service_echo|c":   1,
+		"goc.size_bytes.count|c":                           1,
+		"goc.size_bytes.sum|c":                             100,
+	}
+	for key, value := range want {
+		got, ok := lines[key]
+		if value == 0 {
+			// counters without increments are not sent
+			if ok {
+				t.Errorf("%s sent with value %s", key, got)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s not sent, got %v", key, lines)
+			continue
+		}
+		if v, _ := strconv.ParseFloat(got, 64); v != value {
+			t.Errorf("%s = %s, want %v", key, got, value)
+		}
+	}
+	for key := range lines {
+		if strings.HasPrefix(key, "goc.other") || strings.HasPrefix(key, "go_") {
+			t.Errorf("non goc metric %s pushed", key)
+		}
+	}
+
+	// counters are sent as increments since the last push
+	m.requests.WithLabelValues("echo", "200").Add(2)
+	pusher.push()
+	lines = listener.lines(t)
+	if got := lines["goc.requests_total.code_200.service_echo|c"]; got != "2" {
+		t.Errorf("counter increment %q, want 2", got)
+	}
+	if _, ok := lines["goc.size_bytes.count|c"]; ok {
+		t.Error("unchanged summary count sent")
+	}
+	if got := lines["goc.in_flight|g"]; got != "-2" {
+		t.Errorf("gauge %q, want -2", got)
+	}
+
+	// a reset collector restarts the increments from its new value
+	m.requests.Reset()
+	m.requests.WithLabelValues("echo", "200").Add(1)
+	pusher.push()
+	if got := listener.lines(t)["goc.requests_total.code_200.service_echo|c"]; got != "1" {
+		t.Errorf("counter increment after reset %q, want 1", got)
+	}
+}
+
+func TestPushStatsDNegativeGauge(t *testing.T) {
+	m := newTestPushMetrics(t)
+	listener := newStatsDListener(t)
+	pusher := testPusher(t, m, &Config{StatsDAddress: listener.conn.LocalAddr().String(), StatsDFlavor: statsdPlain})
+	m.inFlight.Set(-2)
+	pusher.push()
+	packets := listener.packets(t)
+	if len(packets) != 1 || !strings.Contains(packets[0], "in_flight:0|g\nin_flight:-2|g") {
+		t.Errorf("negative gauge not reset before being set: %q", packets)
+	}
+}
+
+func TestPushDogStatsD(t *testing.T) {
+	m := newTestPushMetrics(t)
+	listener := newStatsDListener(t)
+	pusher := testPusher(t, m, &Config{StatsDAddress: listener.conn.LocalAddr().String(), StatsDFlavor: statsdDog, MetricsPushPrefix: "goc.", Node: "node 1"})
+	m.requests.WithLabelValues("echo", "200").Add(3)
+	m.latency.WithLabelValues("echo").Observe(0.5)
+	pusher.push()
+
+	lines := listener.lines(t)
+	tests := map[string]string{
+		"goc.requests_total|c|#code:200,service:echo,node:node_1":       "3",
+		"goc.latency_seconds.bucket|c|#le:0.1,service:echo,node:node_1": "",
+		"goc.latency_seconds.bucket|c|#le:1,service:echo,node:node_1":   "1",
+		"goc.latency_seconds.count|c|#service:echo,node:node_1":         "1",
+		"goc.in_flight|g|#node:node_1":                                  "0",
+		"goc.latency_seconds.sum|c|#service:echo,node:node_1":           "0.5",
+	}
+	for key, value := range tests {
+		got, ok := lines[key]
+		if value == "" {
+			if ok {
+				t.Errorf("%s sent with value %s", key, got)
+			}
+			continue
+		}
+		if got != value {
+			t.Errorf("%s = %q, want %s", key, got, value)
+		}
+	}
+}
+
+func TestSendStatsDSplitsPackets(t *testing.T) {
+	listener := newStatsDListener(t)
+	conn, err := net.Dial("udp", listener.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pusher := &MetricsPusher{conn: conn}
+
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, "goc.requests_total."+strings.Repeat("x", 50)+strconv.Itoa(i)+":1|c")
+	}
+	pusher.sendStatsD(lines)
+
+	var received []string
+	packets := listener.packets(t)
+	for _, packet := range packets {
+		if len(packet) > statsdPacketSize {
+			t.Errorf("packet of %v bytes exceeds %v", len(packet), statsdPacketSize)
+		}
+		received = append(received, strings.Split(packet, "\n")...)
+	}
+	if len(packets) < 2 {
+		t.Errorf("%v packets, want the lines split", len(packets))
+	}
+	if strings.Join(received, "\n") != strings.Join(lines, "\n") {
+		t.Errorf("received %v lines, want %v in order", len(received), len(lines))
+	}
+}
+
+// otlpRequest is the part of the ExportMetricsServiceRequest JSON checked by the tests
+type otlpRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []otlpAttribute
+		}
+		ScopeMetrics []struct {
+			Scope   struct{ Name string }
+			Metrics []otlpMetric
+		}
+	}
+}
+
+type otlpAttribute struct {
+	Key   string
+	Value struct{ StringValue string }
+}
+
+type otlpMetric struct {
+	Name      string
+	Sum       *otlpData
+	Gauge     *otlpData
+	Histogram *otlpData
+	Summary   *otlpData
+}
+
+type otlpData struct {
+	AggregationTemporality int
+	IsMonotonic            bool
+	DataPoints             []struct {
+		Attributes     []otlpAttribute
+		AsDouble       float64
+		Count          string
+		Sum            float64
+		ExplicitBounds []float64
+		BucketCounts   []string
+		QuantileValues []struct {
+			Quantile float64
+			Value    float64
+		}
+	}
+}
+
+func TestPushOTLP(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s request with %s", req.Method, req.Header.Get("Content-Type"))
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	m := newTestPushMetrics(t)
+	pusher := testPusher(t, m, &Config{MetricsOTLPEndpoint: collector.URL, MetricsPushPrefix: "goc.", TracingServiceName: "goc-proxy", Node: "node1"})
+	m.requests.WithLabelValues("echo", "200").Add(3)
+	m.inFlight.Set(2)
+	m.latency.WithLabelValues("echo").Observe(0.05)
+	m.latency.WithLabelValues("echo").Observe(0.5)
+	m.latency.WithLabelValues("echo").Observe(2)
+	m.size.Observe(100)
+	m.goRuntime.Inc()
+	pusher.push()
+
+	var request otlpRequest
+	if err := json.Unmarshal(<-bodies, &request); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.ResourceMetrics) != 1 || len(request.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("unexpected request shape %+v", request)
+	}
+	resource := map[string]string{}
+	for _, a := range request.ResourceMetrics[0].Resource.Attributes {
+		resource[a.Key] = a.Value.StringValue
+	}
+	if resource["service.name"] != "goc-proxy" || resource["service.instance.id"] != "node1" {
+		t.Errorf("resource attributes %v", resource)
+	}
+	metrics := map[string]otlpMetric{}
+	for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+	if len(metrics) != 4 {
+		t.Errorf("%v metrics pushed, want the 4 goc metrics", len(metrics))
+	}
+
+	sum := metrics["goc.requests_total"].Sum
+	if sum == nil || sum.AggregationTemporality != 2 || !sum.IsMonotonic || len(sum.DataPoints) != 1 {
+		t.Fatalf("requests sum %+v", sum)
+	}
+	if want := m.gathered(t, "goc_proxy_requests_total", map[string]string{"service": "echo", "code": "200"}); sum.DataPoints[0].AsDouble != want {
+		t.Errorf("requests %v, want %v", sum.DataPoints[0].AsDouble, want)
+	}
+	if len(sum.DataPoints[0].Attributes) != 2 {
+		t.Errorf("requests attributes %+v", sum.DataPoints[0].Attributes)
+	}
+
+	// counters are cumulative, a second push sends the total
+	m.requests.WithLabelValues("echo", "200").Add(2)
+	pusher.push()
+	var second otlpRequest
+	if err := json.Unmarshal(<-bodies, &second); err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range second.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if metric.Name == "goc.requests_total" && metric.Sum.DataPoints[0].AsDouble != 5 {
+			t.Errorf("cumulative requests %v, want 5", metric.Sum.DataPoints[0].AsDouble)
+		}
+	}
+
+	gauge := metrics["goc.in_flight"].Gauge
+	if gauge == nil || gauge.DataPoints[0].AsDouble != m.gathered(t, "goc_proxy_in_flight", nil) {
+		t.Errorf("in flight gauge %+v", gauge)
+	}
+
+	histogram := metrics["goc.latency_seconds"].Histogram
+	if histogram == nil || len(histogram.DataPoints) != 1 {
+		t.Fatalf("latency histogram %+v", histogram)
+	}
+	dp := histogram.DataPoints[0]
+	if want := strconv.FormatFloat(m.gathered(t, "goc_proxy_latency_seconds", map[string]string{"service": "echo"}), 'f', -1, 64); dp.Count != want {
+		t.Errorf("histogram count %s, want %s", dp.Count, want)
+	}
+	if dp.Sum != 2.55 {
+		t.Errorf("histogram sum %v, want 2.55", dp.Sum)
+	}
+	if strings.Join(dp.BucketCounts, ",") != "1,1,1" || len(dp.ExplicitBounds) != 2 || dp.ExplicitBounds[1] != 1 {
+		t.Errorf("histogram bounds %v counts %v, want [0.1 1] [1 1 1]", dp.ExplicitBounds, dp.BucketCounts)
+	}
+
+	summary := metrics["goc.size_bytes"].Summary
+	if summary == nil || summary.DataPoints[0].Count != "1" || summary.DataPoints[0].Sum != 100 {
+		t.Errorf("size summary %+v", summary)
+	}
+}
+
+func TestNewMetricsPusher(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		enabled bool
+		fails   bool
+	}{
+		{name: "disabled", config: &Config{MetricsPushInterval: 10}},
+		{name: "statsd", config: &Config{StatsDAddress: "127.0.0.1:8125", StatsDFlavor: statsdPlain, MetricsPushInterval: 10}, enabled: true},
+		{name: "otlp", config: &Config{MetricsOTLPEndpoint: "http://127.0.0.1:4318/v1/metrics", MetricsPushInterval: 10}, enabled: true},
+		{name: "unknown flavor", config: &Config{StatsDAddress: "127.0.0.1:8125", StatsDFlavor: "graphite", MetricsPushInterval: 10}, fails: true},
+		{name: "no interval", config: &Config{StatsDAddress: "127.0.0.1:8125", StatsDFlavor: statsdPlain}, fails: true},
+	}
+	for _, tt := range tests {
+		pusher, err := NewMetricsPusher(tt.config)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (pusher != nil) != tt.enabled {
+			t.Errorf("%s: pusher enabled %v, want %v", tt.name, pusher != nil, tt.enabled)
+		}
+		if pusher != nil && pusher.conn != nil {
+			pusher.conn.Close()
+		}
+	}
+}
@@ -5,47 +5,255 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
 )
 
-// Registry is an in memory store of Consul catalog
-type Registry struct {
-	Catalog map[string][]string
+// Endpoint is a service instance as discovered by a provider
+type Endpoint struct {
+	Address string
+	Node    string
+	// Datacenter is omitted when unknown so the registry Sha of cached snapshots is unchanged
+	Datacenter string `json:",omitempty"`
+	Tags       []string
+	// Meta holds the Consul service meta, settings read from it take precedence over the tags
+	Meta    map[string]string `json:",omitempty"`
+	Weight  int
+	Connect bool
+}
+
+// RegistrySnapshot is an immutable view of the discovered services,
+// it must not be modified once published
+type RegistrySnapshot struct {
+	Version uint64
+	Catalog map[string][]Endpoint
+	Sources map[string]string
 	Sha     string
-	mutex   sync.RWMutex
+	// Stale is set while some services are routed from the disk cache
+	Stale bool
+	// settings caches the upstream settings parsed from the service tags
+	settings sync.Map
+}
+
+// Registry is an in memory store of the services discovered by the providers.
+// Readers get the current snapshot without locking, writers publish a new snapshot.
+type Registry struct {
+	Guard       *RegistryGuard
+	snapshot    atomic.Value
+	mutex       sync.Mutex
+	subscribers []chan *RegistrySnapshot
+	providers   []string
+	sources     map[string]map[string][]Endpoint
+	synced      map[string]bool
+}
+
+// NewRegistry creates a registry with an empty snapshot,
+// providers are listed in precedence order, the disk cache comes last
+func NewRegistry(providers []string) *Registry {
+	r := &Registry{
+		providers: append(providers, providerCache),
+		sources:   make(map[string]map[string][]Endpoint),
+		synced:    make(map[string]bool),
+	}
+	catalog := make(map[string][]Endpoint)
+	sources := make(map[string]string)
+	r.snapshot.Store(&RegistrySnapshot{
+		Catalog: catalog,
+		Sources: sources,
+		Sha:     makeSHA(catalog, sources),
+	})
+	return r
+}
+
+// Snapshot returns the current registry snapshot
+func (r *Registry) Snapshot() *RegistrySnapshot {
+	return r.snapshot.Load().(*RegistrySnapshot)
 }
 
 // Lookup returns the service endpoints
-func (r *Registry) Lookup(service string) ([]string, error) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
+func (r *Registry) Lookup(service string) ([]Endpoint, error) {
+	return r.Snapshot().Lookup(service)
+}
 
-	endpoints, ok := r.Catalog[service]
+// Lookup returns the service endpoints
+func (s *RegistrySnapshot) Lookup(service string) ([]Endpoint, error) {
+	endpoints, ok := s.Catalog[service]
 	if !ok {
 		return nil, errors.New("service " + service + " not found")
 	}
 	return endpoints, nil
 }
 
-// Update overrides internal catalog
-func (r *Registry) Update(catalog map[string][]string) {
+// Update replaces the provider catalog after a full sync, publishes a new snapshot if the merged catalog
+// has changed and notifies the subscribers. The catalog is owned by the registry after this call.
+func (r *Registry) Update(provider string, catalog map[string][]Endpoint) bool {
+	return r.update(provider, catalog, true)
+}
+
+// UpdateWatch replaces the provider catalog after a watch event,
+// unlike Update it does not count as a sync for the registry guard
+func (r *Registry) UpdateWatch(provider string, catalog map[string][]Endpoint) bool {
+	return r.update(provider, catalog, false)
+}
+
+func (r *Registry) update(provider string, catalog map[string][]Endpoint, full bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// the provider catalogs are replaced only once the guard accepts the update
+	providers := make(map[string]map[string][]Endpoint, len(r.sources)+1)
+	for p, c := range r.sources {
+		providers[p] = c
+	}
+	providers[provider] = catalog
+	if provider != providerCache {
+		r.expireCache(providers, provider)
+	}
+	merged, sources := r.merge(providers)
+
+	// keep serving the last known good registry on sudden mass deregistration
+	current := r.Snapshot()
+	if r.Guard != nil && !r.Guard.Allow(provider, current.Catalog, merged, full) {
+		return false
+	}
+	if _, cached := r.sources[providerCache]; cached {
+		if _, ok := providers[providerCache]; !ok {
+			log.Info("Registry disk cache routes replaced by the providers")
+		}
+	}
+	r.sources = providers
+	if provider != providerCache {
+		r.synced[provider] = true
+	}
+
+	// update registry only if it changed
+	sha := makeSHA(merged, sources)
+	if current.Sha == sha {
+		return false
+	}
+
+	next := &RegistrySnapshot{
+		Version: current.Version + 1,
+		Catalog: merged,
+		Sources: sources,
+		Sha:     sha,
+	}
+	stale := 0
+	for _, provider := range sources {
+		if provider == providerCache {
+			stale++
+		}
+	}
+	next.Stale = stale > 0
+	proxy_registry_stale_services.Set(float64(stale))
+	endpoints := 0
+	for _, e := range merged {
+		endpoints += len(e)
+	}
+	proxy_registry_services.Set(float64(len(merged)))
+	proxy_registry_endpoints.Set(float64(endpoints))
+	proxy_registry_changes_total.Inc()
+	r.snapshot.Store(next)
+
+	for _, ch := range r.subscribers {
+		// drop the pending snapshot so slow subscribers always get the latest one
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- next
+	}
+	return true
+}
+
+// expireCache drops the disk cache routes once every provider has synced,
+// the provider being updated counts as synced. It must be called with the lock held.
+func (r *Registry) expireCache(providers map[string]map[string][]Endpoint, updated string) {
+	if _, ok := providers[providerCache]; !ok {
+		return
+	}
+	for _, provider := range r.providers {
+		if provider != providerCache && provider != updated && !r.synced[provider] {
+			return
+		}
+	}
+	delete(providers, providerCache)
+}
+
+// merge combines the providers catalogs by service name, a service is routed
+// to the endpoints of the first provider in precedence order that has it
+func (r *Registry) merge(providers map[string]map[string][]Endpoint) (map[string][]Endpoint, map[string]string) {
+	catalog := make(map[string][]Endpoint)
+	sources := make(map[string]string)
+	for i := len(r.providers) - 1; i >= 0; i-- {
+		provider := r.providers[i]
+		for service, endpoints := range providers[provider] {
+			if len(endpoints) == 0 {
+				continue
+			}
+			catalog[service] = endpoints
+			sources[service] = provider
+		}
+	}
+	return catalog, sources
+}
+
+// sortEndpoints orders the endpoints by address and node
+func sortEndpoints(endpoints []Endpoint) {
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Address != endpoints[j].Address {
+			return endpoints[i].Address < endpoints[j].Address
+		}
+		return endpoints[i].Node < endpoints[j].Node
+	})
+}
+
+// Subscribe returns a channel that receives the latest snapshot after each update.
+// Intermediate versions are skipped if the subscriber falls behind, use Diff to get the changes.
+func (r *Registry) Subscribe() <-chan *RegistrySnapshot {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	ch := make(chan *RegistrySnapshot, 1)
+	r.subscribers = append(r.subscribers, ch)
+	return ch
+}
+
+// Unsubscribe stops the updates for a channel returned by Subscribe
+func (r *Registry) Unsubscribe(sub <-chan *RegistrySnapshot) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, ch := range r.subscribers {
+		if ch == sub {
+			r.subscribers = append(r.subscribers[:i], r.subscribers[i+1:]...)
+			return
+		}
+	}
+}
 
-	// clean catalog
-	for k := range r.Catalog {
-		delete(r.Catalog, k)
+// Diff returns the services added, removed and changed since a previous snapshot
+func (s *RegistrySnapshot) Diff(prev *RegistrySnapshot) (added []string, removed []string, changed []string) {
+	for service, endpoints := range s.Catalog {
+		old, ok := prev.Catalog[service]
+		if !ok {
+			added = append(added, service)
+		} else if !reflect.DeepEqual(old, endpoints) {
+			changed = append(changed, service)
+		}
 	}
-	// fill catalog
-	for k, v := range catalog {
-		r.Catalog[k] = v
+	for service := range prev.Catalog {
+		if _, ok := s.Catalog[service]; !ok {
+			removed = append(removed, service)
+		}
 	}
-	// update sha
-	r.Sha = makeSHA(r.Catalog)
+	return added, removed, changed
 }
 
-func makeSHA(catalog map[string][]string) string {
-	b, _ := json.Marshal(catalog)
+func makeSHA(catalog map[string][]Endpoint, sources map[string]string) string {
+	b, _ := json.Marshal([]interface{}{catalog, sources})
 	shaValue := sha256.Sum256(b)
 	sha := fmt.Sprintf("%x", shaValue)
 	return sha
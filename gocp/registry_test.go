@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRegistryUnchangedCatalog(t *testing.T) {
+	registry := NewRegistry([]string{providerConsul})
+	updates := registry.Subscribe()
+	defer registry.Unsubscribe(updates)
+	catalog := func() map[string][]Endpoint {
+		return map[string][]Endpoint{"web": {{Address: "10.0.0.1:80", Tags: []string{"v1"}}}}
+	}
+
+	if !registry.Update(providerConsul, catalog()) {
+		t.Fatal("first update not published")
+	}
+	<-updates
+	snapshot := registry.Snapshot()
+	if snapshot.Version != 1 {
+		t.Fatalf("version %v, want 1", snapshot.Version)
+	}
+	for i := 0; i < 3; i++ {
+		if registry.Update(providerConsul, catalog()) || registry.UpdateWatch(providerConsul, catalog()) {
+			t.Fatal("unchanged catalog published")
+		}
+	}
+	if registry.Snapshot() != snapshot {
+		t.Errorf("snapshot replaced by an unchanged catalog, version %v", registry.Snapshot().Version)
+	}
+	select {
+	case s := <-updates:
+		t.Errorf("subscriber notified of the unchanged version %v", s.Version)
+	default:
+	}
+
+	// a service without endpoints is not routed, publishing it does not change the registry
+	empty := catalog()
+	empty["api"] = nil
+	if registry.Update(providerConsul, empty) {
+		t.Error("service without endpoints published")
+	}
+}
+
+func TestRegistrySubscribersGetDiff(t *testing.T) {
+	registry := NewRegistry([]string{providerConsul})
+	updates := registry.Subscribe()
+	defer registry.Unsubscribe(updates)
+	registry.Update(providerConsul, map[string][]Endpoint{
+		"web": {{Address: "10.0.0.1:80"}},
+		"api": {{Address: "10.0.1.1:80"}},
+		"db":  {{Address: "10.0.2.1:5432"}},
+	})
+	prev := <-updates
+
+	tests := []struct {
+		name    string
+		catalog map[string][]Endpoint
+		added   []string
+		removed []string
+		changed []string
+	}{
+		{
+			name:    "added and removed",
+			catalog: map[string][]Endpoint{"web": {{Address: "10.0.0.1:80"}}, "api": {{Address: "10.0.1.1:80"}}, "cache": {{Address: "10.0.3.1:6379"}}},
+			added:   []string{"cache"},
+			removed: []string{"db"},
+		},
+		{
+			name:    "endpoint and tags changed",
+			catalog: map[string][]Endpoint{"web": {{Address: "10.0.0.2:80"}}, "api": {{Address: "10.0.1.1:80", Tags: []string{"v2"}}}, "cache": {{Address: "10.0.3.1:6379"}}},
+			changed: []string{"api", "web"},
+		},
+		{
+			name:    "all removed",
+			catalog: map[string][]Endpoint{},
+			removed: []string{"api", "cache", "web"},
+		},
+	}
+	for _, tt := range tests {
+		registry.Update(providerConsul, tt.catalog)
+		var next *RegistrySnapshot
+		select {
+		case next = <-updates:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no update received", tt.name)
+		}
+		if next.Version != prev.Version+1 {
+			t.Errorf("%s: version %v after %v", tt.name, next.Version, prev.Version)
+		}
+		added, removed, changed := next.Diff(prev)
+		sort.Strings(added)
+		sort.Strings(removed)
+		sort.Strings(changed)
+		if !reflect.DeepEqual(added, tt.added) || !reflect.DeepEqual(removed, tt.removed) || !reflect.DeepEqual(changed, tt.changed) {
+			t.Errorf("%s: diff %v %v %v, want %v %v %v", tt.name, added, removed, changed, tt.added, tt.removed, tt.changed)
+		}
+		prev = next
+	}
+}
+
+func TestRegistrySlowSubscriber(t *testing.T) {
+	registry := NewRegistry([]string{providerConsul})
+	slow := registry.Subscribe()
+	defer registry.Unsubscribe(slow)
+	first := registry.Snapshot()
+
+	// the slow subscriber never reads while the registry is updated
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			registry.Update(providerConsul, map[string][]Endpoint{
+				fmt.Sprintf("web-%v", i): {{Address: fmt.Sprintf("10.0.0.%v:80", i)}},
+			})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked by a slow subscriber")
+	}
+
+	// the pending snapshot is the latest one, the skipped versions are recovered with Diff
+	latest := <-slow
+	if latest != registry.Snapshot() || latest.Version != 100 {
+		t.Errorf("pending snapshot version %v, want the latest %v", latest.Version, registry.Snapshot().Version)
+	}
+	select {
+	case s := <-slow:
+		t.Errorf("intermediate version %v queued", s.Version)
+	default:
+	}
+	added, removed, _ := latest.Diff(first)
+	if !reflect.DeepEqual(added, []string{"web-99"}) || len(removed) != 0 {
+		t.Errorf("diff since the first snapshot %v %v", added, removed)
+	}
+
+	// unsubscribed channels get no updates
+	registry.Unsubscribe(slow)
+	registry.Update(providerConsul, map[string][]Endpoint{"api": {{Address: "10.0.1.1:80"}}})
+	select {
+	case s := <-slow:
+		t.Errorf("unsubscribed channel got version %v", s.Version)
+	default:
+	}
+}
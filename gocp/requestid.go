@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RequestIDs accepts the request ID sent by the caller, or generates one,
+// and propagates it upstream, in the response and in the request logs
+type RequestIDs struct {
+	Header string
+	// Pattern validates the caller IDs, invalid IDs are replaced, nil accepts any ID
+	Pattern *regexp.Regexp
+}
+
+// NewRequestIDs creates the request ID handler from config
+func NewRequestIDs(config *Config) (*RequestIDs, error) {
+	if config.RequestIDHeader == "" {
+		return nil, fmt.Errorf("RequestIDHeader is required")
+	}
+	ids := &RequestIDs{Header: http.CanonicalHeaderKey(config.RequestIDHeader)}
+	if config.RequestIDPattern != "" {
+		pattern, err := regexp.Compile(config.RequestIDPattern)
+		if err != nil {
+			return nil, fmt.Errorf("RequestIDPattern is invalid: %v", err)
+		}
+		ids.Pattern = pattern
+	}
+	return ids, nil
+}
+
+// Handle sets the request ID on the request forwarded upstream and on the response,
+// the returned request carries the ID in its context
+func (r *RequestIDs) Handle(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(r.Header)
+	if id != "" && r.Pattern != nil && !r.Pattern.MatchString(id) {
+		log.Debugf("xproxy: invalid request ID %q from %s replaced", id, req.RemoteAddr)
+		id = ""
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	req.Header.Set(r.Header, id)
+	w.Header().Set(r.Header, id)
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey, id))
+}
+
+// requestIDFrom returns the request ID stored in the context
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestLog returns a logger tagged with the request ID
+func requestLog(req *http.Request) *log.Entry {
+	return log.WithField("request_id", requestIDFrom(req.Context()))
+}
+
+// newRequestID returns a random 128 bit hex ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
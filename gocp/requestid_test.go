@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// defaultRequestIDPattern is the RequestIDPattern flag default
+const defaultRequestIDPattern = `^[A-Za-z0-9._:+/=-]{1,128}$`
+
+var generatedRequestID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func TestRequestIDsHandle(t *testing.T) {
+	ids, err := NewRequestIDs(&Config{RequestIDHeader: "x-request-id", RequestIDPattern: defaultRequestIDPattern})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		id   string
+		keep bool
+	}{
+		{name: "valid", id: "req-1:a/b+c=", keep: true},
+		{name: "longest", id: strings.Repeat("a", 128), keep: true},
+		{name: "missing", id: ""},
+		{name: "too long", id: strings.Repeat("a", 129)},
+		{name: "space", id: "req 1"},
+		{name: "header injection", id: "req-1\r\nX-Admin: 1"},
+		{name: "html", id: "<script>"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/echo/", nil)
+		if tt.id != "" {
+			req.Header["X-Request-Id"] = []string{tt.id}
+		}
+		w := httptest.NewRecorder()
+		req = ids.Handle(w, req)
+
+		id := requestIDFrom(req.Context())
+		if tt.keep && id != tt.id {
+			t.Errorf("%s: ID %q, want the caller ID kept", tt.name, id)
+		}
+		if !tt.keep && !generatedRequestID.MatchString(id) {
+			t.Errorf("%s: ID %q, want a generated ID", tt.name, id)
+		}
+		if got := req.Header.Get("X-Request-ID"); got != id {
+			t.Errorf("%s: upstream header %q, want %q", tt.name, got, id)
+		}
+		if got := w.Header().Get("X-Request-ID"); got != id {
+			t.Errorf("%s: response header %q, want %q", tt.name, got, id)
+		}
+	}
+
+	// generated IDs are unique
+	a := requestIDFrom(ids.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)).Context())
+	b := requestIDFrom(ids.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)).Context())
+	if a == b {
+		t.Errorf("generated ID %s reused", a)
+	}
+}
+
+func TestRequestIDsAnyID(t *testing.T) {
+	ids, err := NewRequestIDs(&Config{RequestIDHeader: "X-Correlation-ID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/echo/", nil)
+	req.Header.Set("X-Correlation-ID", "any id")
+	w := httptest.NewRecorder()
+	if id := requestIDFrom(ids.Handle(w, req).Context()); id != "any id" {
+		t.Errorf("ID %q, want the caller ID without a pattern", id)
+	}
+	if w.Header().Get("X-Correlation-ID") != "any id" {
+		t.Errorf("response header %q", w.Header().Get("X-Correlation-ID"))
+	}
+}
+
+func TestNewRequestIDsErrors(t *testing.T) {
+	if _, err := NewRequestIDs(&Config{}); err == nil {
+		t.Error("expected an error without header")
+	}
+	if _, err := NewRequestIDs(&Config{RequestIDHeader: "X-Request-ID", RequestIDPattern: "[a-"}); err == nil {
+		t.Error("expected an error with an invalid pattern")
+	}
+}
+
+func TestReverseHandlerRequestID(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Header.Get("X-Request-ID"))
+	}))
+	defer backend.Close()
+	config := &Config{HttpScheme: "http", MaxIdleConnsPerHost: 500, IdleConnTimeout: 90, RequestIDPattern: defaultRequestIDPattern}
+	handler := testReverseProxy(t, backend.URL, config).ReverseHandlerFunc()
+
+	for _, id := range []string{"req-1", strings.Repeat("a", 200)} {
+		req := httptest.NewRequest(http.MethodGet, "/echo/", nil)
+		req.Header.Set("X-Request-ID", id)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		sent := w.Header().Get("X-Request-ID")
+		if w.Body.String() != sent {
+			t.Errorf("upstream ID %q, response ID %q", w.Body.String(), sent)
+		}
+		if keep := len(id) <= 128; keep != (sent == id) {
+			t.Errorf("ID %.10s... kept %v, want %v", id, sent == id, keep)
+		}
+	}
+
+	// error responses carry the ID too
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/missing/", nil)
+	req.Header.Set("X-Request-ID", "req-2")
+	handler(w, req)
+	if w.Code != http.StatusNotFound || w.Header().Get("X-Request-ID") != "req-2" || !strings.Contains(w.Body.String(), `"request_id":"req-2"`) {
+		t.Errorf("error response %v %q %s", w.Code, w.Header().Get("X-Request-ID"), w.Body.String())
+	}
+}
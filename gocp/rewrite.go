@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// route prefix modes
+const (
+	prefixKeep    = "keep"
+	prefixStrip   = "strip"
+	prefixReplace = "replace"
+)
+
+// PathRewrite rewrites the request path with a regular expression,
+// the replacement can reference the capture groups with $1 or ${name}
+type PathRewrite struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	regex       *regexp.Regexp
+}
+
+// prefixRewrite maps the path prefix seen by the caller to the prefix sent upstream,
+// an empty To strips the prefix
+type prefixRewrite struct {
+	From string
+	To   string
+}
+
+// routePrefix returns the prefix rewrite of the route, nil when the prefix is kept
+func routePrefix(route *Route) *prefixRewrite {
+	switch route.Prefix {
+	case prefixStrip:
+		return &prefixRewrite{From: strings.TrimSuffix(route.Path, "/")}
+	case prefixReplace:
+		return &prefixRewrite{From: strings.TrimSuffix(route.Path, "/"), To: strings.TrimSuffix(route.PrefixReplace, "/")}
+	}
+	return nil
+}
+
+// validateRewrite checks the prefix mode and compiles the path rewrite of the route
+func validateRewrite(route *Route) error {
+	switch route.Prefix {
+	case "":
+		route.Prefix = prefixKeep
+	case prefixKeep:
+	case prefixStrip, prefixReplace:
+		if route.Path == "" {
+			return fmt.Errorf("route %s prefix %s requires a path", route.Name, route.Prefix)
+		}
+		if route.Prefix == prefixReplace && !strings.HasPrefix(route.PrefixReplace, "/") {
+			return fmt.Errorf("route %s prefix_replace must start with /", route.Name)
+		}
+	default:
+		return fmt.Errorf("route %s prefix must be %s, %s or %s", route.Name, prefixKeep, prefixStrip, prefixReplace)
+	}
+	if route.Rewrite != nil {
+		regex, err := regexp.Compile(route.Rewrite.Regex)
+		if err != nil {
+			return fmt.Errorf("route %s rewrite regex is invalid: %v", route.Name, err)
+		}
+		route.Rewrite.regex = regex
+	}
+	return nil
+}
+
+// rewriteRequest applies the prefix and regex rewrites to the request URL,
+// the path encoding and the query are kept as sent by the caller.
+// It fails when the request path does not start with the prefix.
+func rewriteRequest(req *http.Request, prefix *prefixRewrite, rewrite *PathRewrite) error {
+	if prefix != nil {
+		rest, ok := prefix.strip(req.URL)
+		if !ok {
+			return fmt.Errorf("path %s does not match prefix %s", req.URL.EscapedPath(), prefix.From)
+		}
+		setEscapedPath(req.URL, joinPath(prefix.To, rest))
+		if prefix.From != "" {
+			req.Header.Set("X-Forwarded-Prefix", prefix.From)
+		}
+	}
+	if rewrite != nil {
+		setEscapedPath(req.URL, rewrite.regex.ReplaceAllString(req.URL.EscapedPath(), rewrite.Replacement))
+	}
+	return nil
+}
+
+// strip returns the escaped path following the prefix, the prefix is matched
+// on the escaped path as sent by the caller then on the decoded path
+func (p *prefixRewrite) strip(u *url.URL) (string, bool) {
+	escaped := u.EscapedPath()
+	if escaped == "" {
+		// absolute form requests such as GET http://host HTTP/1.1 have no path
+		escaped = "/"
+	}
+	if strings.HasPrefix(escaped, p.From) {
+		return escaped[len(p.From):], true
+	}
+	// the prefix was matched on the decoded path, skip its escaped bytes
+	// so the encoding of the rest is kept
+	i := 0
+	for matched := 0; matched < len(p.From); matched++ {
+		if i >= len(escaped) {
+			return "", false
+		}
+		c, n := escaped[i], 1
+		if c == '%' && i+2 < len(escaped) {
+			if v, err := strconv.ParseUint(escaped[i+1:i+3], 16, 8); err == nil {
+				c, n = byte(v), 3
+			}
+		}
+		if c != p.From[matched] {
+			return "", false
+		}
+		i += n
+	}
+	return escaped[i:], true
+}
+
+// rewriteResponse maps the upstream paths of the Location header and of the cookies to the caller paths
+func rewriteResponse(resp *http.Response) error {
+	prefix, ok := resp.Request.Context().Value(prefixKey).(*prefixRewrite)
+	if !ok {
+		return nil
+	}
+	if location := resp.Header.Get("Location"); location != "" {
+		if u, err := url.Parse(location); err == nil && (u.Host == "" || u.Host == resp.Request.URL.Host) && strings.HasPrefix(u.Path, "/") {
+			if p, ok := prefix.reverse(u.EscapedPath()); ok {
+				u.Scheme = ""
+				u.Host = ""
+				setEscapedPath(u, p)
+				resp.Header.Set("Location", u.String())
+			}
+		}
+	}
+	cookies := resp.Header["Set-Cookie"]
+	for i, cookie := range cookies {
+		cookies[i] = prefix.reverseCookie(cookie)
+	}
+	return nil
+}
+
+// reverse maps an upstream path to the caller path
+func (p *prefixRewrite) reverse(path string) (string, bool) {
+	if p.To == "" {
+		return joinPath(p.From, path), true
+	}
+	if !matchPathPrefix(p.To, path) {
+		return "", false
+	}
+	return joinPath(p.From, path[len(p.To):]), true
+}
+
+// reverseCookie maps the Path attribute of a Set-Cookie header
+func (p *prefixRewrite) reverseCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts {
+		attr := strings.TrimSpace(part)
+		if len(attr) < 5 || !strings.EqualFold(attr[:5], "path=") {
+			continue
+		}
+		if path, ok := p.reverse(attr[5:]); ok {
+			parts[i] = " Path=" + path
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// joinPath appends a path to a prefix without doubling the slash
+func joinPath(prefix string, path string) string {
+	if path == "" {
+		path = "/"
+	}
+	if path[0] != '/' {
+		path = "/" + path
+	}
+	if prefix == "" {
+		return path
+	}
+	if path == "/" {
+		return prefix + "/"
+	}
+	return prefix + path
+}
+
+// setEscapedPath sets the URL path from its escaped form so the caller encoding is preserved
+func setEscapedPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		u.Path = escaped
+		u.RawPath = ""
+		return
+	}
+	u.Path = path
+	u.RawPath = escaped
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRewriteRequestPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		prefix *prefixRewrite
+		path   string
+		fails  bool
+	}{
+		{name: "strip", target: "/svc/a/b", prefix: &prefixRewrite{From: "/svc"}, path: "/a/b"},
+		{name: "strip all", target: "/svc", prefix: &prefixRewrite{From: "/svc"}, path: "/"},
+		{name: "replace", target: "/svc/a", prefix: &prefixRewrite{From: "/svc", To: "/api"}, path: "/api/a"},
+		{name: "root route", target: "/a", prefix: &prefixRewrite{From: ""}, path: "/a"},
+		{name: "empty path", target: "http://example.com", prefix: &prefixRewrite{From: "/"}, path: "/"},
+		{name: "empty path with service prefix", target: "http://example.com", prefix: &prefixRewrite{From: "/svc"}, fails: true},
+		{name: "asterisk", target: "*", prefix: &prefixRewrite{From: "/" + url.PathEscape("*")}, fails: true},
+		{name: "other prefix", target: "/other/a", prefix: &prefixRewrite{From: "/svc"}, fails: true},
+		{name: "escaped prefix", target: "/my%20svc/a%2Fb", prefix: &prefixRewrite{From: "/my%20svc"}, path: "/a%2Fb"},
+		{name: "decoded prefix", target: "/my%20svc/a%2Fb", prefix: &prefixRewrite{From: "/my svc"}, path: "/a%2Fb"},
+		{name: "encoded by caller", target: "/%61lpha/b", prefix: &prefixRewrite{From: "/alpha"}, path: "/b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.ParseRequestURI(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}
+			err = rewriteRequest(req, tt.prefix, nil)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got path %s", req.URL.EscapedPath())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := req.URL.EscapedPath(); got != tt.path {
+				t.Errorf("path %s, want %s", got, tt.path)
+			}
+		})
+	}
+}
+
+func TestRewriteRequestRegex(t *testing.T) {
+	rewrite := &PathRewrite{Regex: `^/v1/(.*)$`, Replacement: "/api/$1"}
+	route := &Route{Name: "v1", Rewrite: rewrite}
+	if err := validateRewrite(route); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.ParseRequestURI("/v1/users?id=1")
+	req := &http.Request{URL: u, Header: http.Header{}}
+	if err := rewriteRequest(req, nil, rewrite); err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.String() != "/api/users?id=1" {
+		t.Errorf("URL %s, want /api/users?id=1", req.URL.String())
+	}
+}
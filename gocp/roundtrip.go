@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// round trip error classes
+const (
+	errorDial     = "dial"
+	errorTimeout  = "timeout"
+	errorReset    = "reset"
+	errorTLS      = "tls"
+	errorCanceled = "canceled"
+	errorOther    = "other"
+)
+
+// statusClassError labels the round trips ended by a transport error
+const statusClassError = "error"
+
+// RoundTripMetrics records the upstream round trips rate, errors and duration,
+// the histograms can be labeled with the method and the status class
+type RoundTripMetrics struct {
+	MethodLabel      bool
+	StatusClassLabel bool
+	// Legacy keeps the roundtrips_total and roundtrips_latency series
+	Legacy bool
+	// SLOs tracks the error budgets, the proxy handler records the requests outcome
+	SLOs *SLOTable
+
+	requests     *prometheus.CounterVec
+	errors       *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	ttfb         *prometheus.HistogramVec
+	requestSize  *prometheus.HistogramVec
+	responseSize *prometheus.HistogramVec
+	inFlight     *prometheus.GaugeVec
+}
+
+// NewRoundTripMetrics creates the round trip metrics with the buckets and labels from config
+func NewRoundTripMetrics(config *Config) (*RoundTripMetrics, error) {
+	latency, err := parseBuckets(config.MetricsLatencyBuckets)
+	if err != nil {
+		return nil, fmt.Errorf("MetricsLatencyBuckets: %v", err)
+	}
+	sizes, err := parseBuckets(config.MetricsSizeBuckets)
+	if err != nil {
+		return nil, fmt.Errorf("MetricsSizeBuckets: %v", err)
+	}
+	m := &RoundTripMetrics{
+		MethodLabel:      config.MetricsMethodLabel,
+		StatusClassLabel: config.MetricsStatusClassLabel,
+		Legacy:           config.MetricsLegacy,
+	}
+
+	labels := []string{"service"}
+	if m.MethodLabel {
+		labels = append(labels, "method")
+	}
+	sizeLabels := labels
+	if m.StatusClassLabel {
+		labels = append(labels, "status_class")
+	}
+
+	m.requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "goc",
+			Subsystem: "proxy",
+			Name:      "upstream_requests_total",
+			Help:      "The total number of upstream responses by service and status code.",
+		},
+		append(append([]string{}, sizeLabels...), "code"),
+	)
+	m.errors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "goc",
+			Subsystem: "proxy",
+			Name:      "upstream_errors_total",
+			Help:      "The total number of upstream round trip errors by class: dial, timeout, reset, tls, canceled or other.",
+		},
+		[]string{"service", "class"},
+	)
+	m.duration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "goc",
+			Subsystem: "proxy",
+			Name:      "upstream_duration_seconds",
+			Help:      "The duration of upstream round trips, until the response body is read.",
+			Buckets:   latency,
+		},
+		labels,
+	)
+	m.ttfb = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "goc",
+			Subsystem: "proxy",
+			Name:      "upstream_ttfb_seconds",
+			Help:      "The time to the first byte of the upstream responses, when the headers are received.",
+			Buckets:   latency,
+		},
+		labels,
+	)
+	m.requestSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "goc",
+			Subsystem: "proxy",
+			Name:      "upstream_request_size_bytes",
+			Help:      "The size of the request bodies sent upstream.",
+			Buckets:   sizes,
+		},
+		sizeLabels,
+	)
+	m.responseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "goc",
+			Subsystem: "proxy",
+			Name:      "upstream_response_size_bytes",
+			Help:      "The size of the upstream response bodies.",
+			Buckets:   sizes,
+		},
+		sizeLabels,
+	)
+	m.inFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goc",
+			Subsystem: "proxy",
+			Name:      "upstream_in_flight",
+			Help:      "The number of upstream round trips in progress.",
+		},
+		[]string{"service"},
+	)
+	return m, nil
+}
+
+// register exposes the round trip metrics, the legacy series are kept during the migration
+func (m *RoundTripMetrics) register() {
+	prometheus.MustRegister(m.requests)
+	prometheus.MustRegister(m.errors)
+	prometheus.MustRegister(m.duration)
+	prometheus.MustRegister(m.ttfb)
+	prometheus.MustRegister(m.requestSize)
+	prometheus.MustRegister(m.responseSize)
+	prometheus.MustRegister(m.inFlight)
+	if m.Legacy {
+		prometheus.MustRegister(proxy_roundtrips_total)
+		prometheus.MustRegister(proxy_roundtrips_latency)
+	}
+	if m.SLOs != nil {
+		prometheus.MustRegister(m.SLOs)
+	}
+}
+
+// start counts the round trip in flight and returns its recorder
+func (m *RoundTripMetrics) start(service string, req *http.Request) *roundTrip {
+	m.inFlight.WithLabelValues(service).Inc()
+	rt := &roundTrip{metrics: m, service: service, method: req.Method, start: time.Now()}
+	if req.Body != nil && req.Body != http.NoBody {
+		// the transport writes the body concurrently with the response, its size is recorded once it is closed
+		body := &countingReader{ReadCloser: req.Body}
+		body.onClose = func() { m.requestSize.WithLabelValues(rt.sizeLabels()...).Observe(float64(body.read())) }
+		rt.requestBody = true
+		req.Body = body
+	}
+	return rt
+}
+
+// roundTrip records a single upstream round trip
+type roundTrip struct {
+	metrics     *RoundTripMetrics
+	service     string
+	method      string
+	start       time.Time
+	requestBody bool
+	once        sync.Once
+}
+
+// failed records a round trip ended by a transport error
+func (rt *roundTrip) failed(req *http.Request, err error) {
+	m := rt.metrics
+	m.errors.WithLabelValues(rt.service, classifyError(req, err)).Inc()
+	if m.Legacy {
+		// status code 5000 stands for transport errors in the legacy series
+		proxy_roundtrips_total.WithLabelValues(rt.service, strconv.Itoa(5000)).Inc()
+		proxy_roundtrips_latency.WithLabelValues(rt.service).Observe(time.Since(rt.start).Seconds())
+	}
+	rt.finish(0, statusClassError)
+}
+
+// responded records the response headers and defers the end of the round trip
+// to the response body close
+func (rt *roundTrip) responded(resp *http.Response) {
+	m := rt.metrics
+	elapsed := time.Since(rt.start).Seconds()
+	m.ttfb.WithLabelValues(rt.labels(statusClass(resp.StatusCode))...).Observe(elapsed)
+	m.requests.WithLabelValues(append(rt.sizeLabels(), strconv.Itoa(resp.StatusCode))...).Inc()
+	if m.Legacy {
+		proxy_roundtrips_total.WithLabelValues(rt.service, strconv.Itoa(resp.StatusCode)).Inc()
+		proxy_roundtrips_latency.WithLabelValues(rt.service).Observe(elapsed)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the upgraded connection body must stay writable for the reverse proxy,
+		// the round trip ends with the handshake
+		rt.finish(0, statusClass(resp.StatusCode))
+		return
+	}
+	body := &countingReader{ReadCloser: resp.Body}
+	body.onClose = func() { rt.finish(body.read(), statusClass(resp.StatusCode)) }
+	resp.Body = body
+}
+
+// finish observes the duration and the response size once the response body is closed,
+// the size of a request with a body is observed when the transport closes it
+func (rt *roundTrip) finish(responseBytes int64, class string) {
+	rt.once.Do(func() {
+		m := rt.metrics
+		m.inFlight.WithLabelValues(rt.service).Dec()
+		m.duration.WithLabelValues(rt.labels(class)...).Observe(time.Since(rt.start).Seconds())
+		if !rt.requestBody {
+			m.requestSize.WithLabelValues(rt.sizeLabels()...).Observe(0)
+		}
+		if class != statusClassError {
+			m.responseSize.WithLabelValues(rt.sizeLabels()...).Observe(float64(responseBytes))
+		}
+	})
+}
+
+func (rt *roundTrip) sizeLabels() []string {
+	if rt.metrics.MethodLabel {
+		return []string{rt.service, rt.method}
+	}
+	return []string{rt.service}
+}
+
+func (rt *roundTrip) labels(class string) []string {
+	labels := rt.sizeLabels()
+	if rt.metrics.StatusClassLabel {
+		labels = append(labels, class)
+	}
+	return labels
+}
+
+// countingReader counts the bytes read from a body, onClose is called on the first close
+type countingReader struct {
+	io.ReadCloser
+	bytes   int64
+	onClose func()
+	closed  sync.Once
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.bytes, int64(n))
+	return n, err
+}
+
+// read returns the bytes read so far
+func (c *countingReader) read() int64 {
+	return atomic.LoadInt64(&c.bytes)
+}
+
+func (c *countingReader) Close() error {
+	err := c.ReadCloser.Close()
+	if c.onClose != nil {
+		c.closed.Do(c.onClose)
+	}
+	return err
+}
+
+// statusClass returns 2xx for 200
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// classifyError maps a round trip error to an error class
+func classifyError(req *http.Request, err error) string {
+	if errors.Is(err, context.Canceled) || req.Context().Err() == context.Canceled {
+		return errorCanceled
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errorTimeout
+	}
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &certErr) || strings.Contains(err.Error(), "tls: ") {
+		return errorTLS
+	}
+	var opErr *net.OpError
+	if (errors.As(err, &opErr) && opErr.Op == "dial") || errors.Is(err, syscall.ECONNREFUSED) {
+		return errorDial
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errorReset
+	}
+	return errorOther
+}
+
+// parseBuckets parses a comma separated list of increasing histogram bucket bounds
+func parseBuckets(list string) ([]float64, error) {
+	var buckets []float64
+	for _, part := range strings.Split(list, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		bound, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %s", part)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be in increasing order")
+		}
+		buckets = append(buckets, bound)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("at least one bucket is required")
+	}
+	return buckets, nil
+}
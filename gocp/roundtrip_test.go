@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func testRoundTripMetrics(t testing.TB) *RoundTripMetrics {
+	m, err := NewRoundTripMetrics(&Config{MetricsLatencyBuckets: "0.1,1", MetricsSizeBuckets: "100,1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestProxyTransportUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	proxy := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+		},
+		Transport: &ProxyTransport{Service: "echo", Transport: &http.Transport{}, Metrics: testRoundTripMetrics(t)},
+	})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: echo\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %v, want 101", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo %q, want ping", buf)
+	}
+}
+
+// histogramSample returns the sample count and sum of a histogram series
+func histogramSample(t *testing.T, vec *prometheus.HistogramVec, labels ...string) (uint64, float64) {
+	var metric dto.Metric
+	if err := vec.WithLabelValues(labels...).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+}
+
+func TestRoundTripSizes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		io.WriteString(w, strings.ToUpper(string(body))+"!")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		body     string
+		request  float64
+		response float64
+	}{
+		{name: "no body", body: "", request: 0, response: 1},
+		{name: "body", body: strings.Repeat("x", 500), request: 500, response: 501},
+		{name: "large body", body: strings.Repeat("x", 1<<20), request: 1 << 20, response: 1<<20 + 1},
+	}
+	for _, tt := range tests {
+		metrics := testRoundTripMetrics(t)
+		transport := &ProxyTransport{Service: "echo", Transport: &http.Transport{}, Metrics: metrics}
+		var body io.Reader
+		if tt.body != "" {
+			body = strings.NewReader(tt.body)
+		}
+		req := httptest.NewRequest(http.MethodPost, backend.URL, body)
+		req.RequestURI = ""
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		// the transport closes the request body once written
+		deadline := time.Now().Add(time.Second)
+		count, sum := histogramSample(t, metrics.requestSize, "echo")
+		for count == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			count, sum = histogramSample(t, metrics.requestSize, "echo")
+		}
+		if count != 1 || sum != tt.request {
+			t.Errorf("%s: request size count %v sum %v, want 1 %v", tt.name, count, sum, tt.request)
+		}
+		if count, sum := histogramSample(t, metrics.responseSize, "echo"); count != 1 || sum != tt.response {
+			t.Errorf("%s: response size count %v sum %v, want 1 %v", tt.name, count, sum, tt.response)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	consul_api "github.com/hashicorp/consul/api"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Route is a rule of the route table, all its matchers must match the request.
+// Host accepts a leading wildcard, *.example.com, Path is a prefix matched on path segments
+// and a header with an empty value only has to be present.
+// The Path prefix is kept, stripped or replaced before the optional regex rewrite.
+type Route struct {
+	Name          string            `yaml:"name"`
+	Host          string            `yaml:"host"`
+	Path          string            `yaml:"path"`
+	PathRegex     string            `yaml:"path_regex"`
+	Methods       []string          `yaml:"methods"`
+	Headers       map[string]string `yaml:"headers"`
+	Service       string            `yaml:"service"`
+	Tags          []string          `yaml:"tags"`
+	Prefix        string            `yaml:"prefix"`
+	PrefixReplace string            `yaml:"prefix_replace"`
+	Rewrite       *PathRewrite      `yaml:"rewrite"`
+	pathRegex     *regexp.Regexp
+}
+
+// routeFile is the route table format, stored in a file or a Consul KV key:
+//
+//	routes:
+//	  - name: billing-canary
+//	    host: "*.example.com"
+//	    path: /billing
+//	    methods: [GET]
+//	    headers:
+//	      X-Canary: "true"
+//	    service: billing
+//	    tags: [canary]
+//	    prefix: replace
+//	    prefix_replace: /v2
+//	    rewrite:
+//	      regex: ^/v2/invoices/([0-9]+)$
+//	      replacement: /v2/invoice/$1
+type routeFile struct {
+	Routes []*Route `yaml:"routes"`
+}
+
+// RouteTable holds the ordered routes loaded from a file or a Consul KV key,
+// requests matching no route fall back to the path or domain routing
+type RouteTable struct {
+	routes atomic.Value
+	source *watchedSource
+}
+
+// NewRouteTable creates the route table, it returns nil when no route source is configured
+func NewRouteTable(config *Config, client *consul_api.Client) (*RouteTable, error) {
+	if config.RouteFile == "" && config.RouteKVKey == "" {
+		return nil, nil
+	}
+	if config.RouteFile != "" && config.RouteKVKey != "" {
+		return nil, fmt.Errorf("RouteFile and RouteKVKey are mutually exclusive")
+	}
+	t := &RouteTable{}
+	t.routes.Store([]*Route{})
+	t.source = newWatchedSource(config.RouteFile, config.RouteFileInterval, config.RouteKVKey, client, t.apply)
+	return t, nil
+}
+
+// Routes returns the current route table
+func (t *RouteTable) Routes() []*Route {
+	if t == nil {
+		return nil
+	}
+	return t.routes.Load().([]*Route)
+}
+
+// Match returns the first route matching the request
+func (t *RouteTable) Match(req *http.Request) (*Route, bool) {
+	for _, route := range t.Routes() {
+		if route.match(req) {
+			return route, true
+		}
+	}
+	return nil, false
+}
+
+// Start loads the route table and watches its source for changes
+func (t *RouteTable) Start() {
+	t.source.Start()
+}
+
+// Stop ends the route source watch
+func (t *RouteTable) Stop() {
+	t.source.Stop()
+}
+
+// apply replaces the route table, an invalid table is ignored and the last good one is kept
+func (t *RouteTable) apply(source string, data []byte) {
+	routes, err := parseRoutes(data)
+	if err != nil {
+		log.Errorf("Route table from %s is invalid, keeping the last table: %s", source, err.Error())
+		return
+	}
+	t.routes.Store(routes)
+	log.Infof("Route table loaded from %s with %v routes", source, len(routes))
+}
+
+// parseRoutes parses and validates a YAML or JSON route table
+func parseRoutes(data []byte) ([]*Route, error) {
+	var file routeFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	routes := make([]*Route, 0, len(file.Routes))
+	for i, route := range file.Routes {
+		if route == nil {
+			return nil, fmt.Errorf("route %v is empty", i)
+		}
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%v", i)
+		}
+		if route.Service == "" {
+			return nil, fmt.Errorf("route %s has no service", route.Name)
+		}
+		if route.Path != "" && !strings.HasPrefix(route.Path, "/") {
+			return nil, fmt.Errorf("route %s path must start with /", route.Name)
+		}
+		if strings.Contains(strings.TrimPrefix(route.Host, "*."), "*") {
+			return nil, fmt.Errorf("route %s host only accepts a leading wildcard", route.Name)
+		}
+		route.Host = strings.ToLower(route.Host)
+		if route.PathRegex != "" {
+			regex, err := regexp.Compile(route.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("route %s path_regex is invalid: %v", route.Name, err)
+			}
+			route.pathRegex = regex
+		}
+		if err := validateRewrite(route); err != nil {
+			return nil, err
+		}
+		for j, method := range route.Methods {
+			route.Methods[j] = strings.ToUpper(method)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+func (route *Route) match(req *http.Request) bool {
+	if route.Host != "" && !matchHost(route.Host, req.Host) {
+		return false
+	}
+	if route.Path != "" && !matchPathPrefix(route.Path, req.URL.Path) {
+		return false
+	}
+	if route.pathRegex != nil && !route.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(route.Methods) > 0 {
+		allowed := false
+		for _, method := range route.Methods {
+			if method == req.Method {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for name, value := range route.Headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if value != "" && (len(values) == 0 || values[0] != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHost compares the request host, without port, to an exact or *.domain pattern
+func matchHost(pattern string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// matchPathPrefix matches whole path segments, /api matches /api and /api/v1 but not /apis
+func matchPathPrefix(prefix string, path string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// taggedEndpoints returns the endpoints having all the tags
+func taggedEndpoints(endpoints []Endpoint, tags []string) []Endpoint {
+	if len(tags) == 0 {
+		return endpoints
+	}
+	var subset []Endpoint
+	for _, e := range endpoints {
+		all := true
+		for _, tag := range tags {
+			if _, ok := tagValue(e.Tags, tag); !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			subset = append(subset, e)
+		}
+	}
+	return subset
+}
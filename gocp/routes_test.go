@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testRouteTable = `
+routes:
+  - name: admin
+    host: admin.example.com
+    service: admin
+  - name: billing-canary
+    host: "*.example.com"
+    path: /billing
+    methods: [get]
+    headers:
+      X-Canary: "true"
+    service: billing
+    tags: [canary]
+  - name: billing
+    path: /billing
+    service: billing
+  - name: reports
+    path_regex: ^/reports/[0-9]+$
+    headers:
+      Authorization: ""
+    service: reports
+`
+
+func TestRouteTableMatch(t *testing.T) {
+	routes, err := parseRoutes([]byte(testRouteTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := &RouteTable{}
+	table.routes.Store(routes)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		host    string
+		headers map[string]string
+		route   string
+	}{
+		{name: "exact host", target: "/billing", host: "admin.example.com", route: "admin"},
+		{name: "host with port", target: "/", host: "ADMIN.example.com:8080", route: "admin"},
+		{name: "wildcard host with headers", target: "/billing/invoices", host: "eu.example.com", headers: map[string]string{"X-Canary": "true"}, route: "billing-canary"},
+		{name: "header value mismatch", target: "/billing/invoices", host: "eu.example.com", headers: map[string]string{"X-Canary": "false"}, route: "billing"},
+		{name: "method mismatch", method: http.MethodPost, target: "/billing", host: "eu.example.com", headers: map[string]string{"X-Canary": "true"}, route: "billing"},
+		{name: "wildcard excludes apex", target: "/billing", host: "example.com", headers: map[string]string{"X-Canary": "true"}, route: "billing"},
+		{name: "path segment", target: "/billings", host: "proxy"},
+		{name: "regex with header present", target: "/reports/42", host: "proxy", headers: map[string]string{"Authorization": "Bearer x"}, route: "reports"},
+		{name: "regex without header", target: "/reports/42", host: "proxy"},
+		{name: "regex mismatch", target: "/reports/latest", host: "proxy", headers: map[string]string{"Authorization": "Bearer x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.target, nil)
+			req.Host = tt.host
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			route, ok := table.Match(req)
+			if tt.route == "" {
+				if ok {
+					t.Fatalf("matched route %s, want none", route.Name)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("no route matched, want %s", tt.route)
+			}
+			if route.Name != tt.route {
+				t.Errorf("matched route %s, want %s", route.Name, tt.route)
+			}
+		})
+	}
+
+	var empty *RouteTable
+	if _, ok := empty.Match(httptest.NewRequest(http.MethodGet, "/", nil)); ok {
+		t.Error("nil route table matched a request")
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		table string
+	}{
+		{name: "no service", table: "routes:\n  - path: /a\n"},
+		{name: "relative path", table: "routes:\n  - path: a\n    service: a\n"},
+		{name: "inner wildcard", table: "routes:\n  - host: a.*.com\n    service: a\n"},
+		{name: "invalid regex", table: "routes:\n  - path_regex: (\n    service: a\n"},
+		{name: "unknown field", table: "routes:\n  - service: a\n    weight: 1\n"},
+		{name: "empty route", table: "routes:\n  -\n"},
+	}
+	for _, tt := range tests {
+		if _, err := parseRoutes([]byte(tt.table)); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestMatchPathPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{prefix: "/api", path: "/api", want: true},
+		{prefix: "/api", path: "/api/v1", want: true},
+		{prefix: "/api", path: "/apis", want: false},
+		{prefix: "/api/", path: "/api/v1", want: true},
+		{prefix: "/api/", path: "/api", want: false},
+		{prefix: "/", path: "/anything", want: true},
+		{prefix: "/api", path: "/", want: false},
+	}
+	for _, tt := range tests {
+		if got := matchPathPrefix(tt.prefix, tt.path); got != tt.want {
+			t.Errorf("matchPathPrefix(%s, %s) = %v, want %v", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTaggedEndpoints(t *testing.T) {
+	endpoints := []Endpoint{
+		{Address: "10.0.0.1:80", Tags: []string{"canary", "zone=eu"}},
+		{Address: "10.0.0.2:80", Tags: []string{"zone=us"}},
+		{Address: "10.0.0.3:80", Tags: []string{"canary"}},
+	}
+	tests := []struct {
+		name string
+		tags []string
+		want []string
+	}{
+		{name: "no tags", want: []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}},
+		{name: "single tag", tags: []string{"canary"}, want: []string{"10.0.0.1:80", "10.0.0.3:80"}},
+		{name: "key of a key=value tag", tags: []string{"zone"}, want: []string{"10.0.0.1:80", "10.0.0.2:80"}},
+		{name: "all tags", tags: []string{"canary", "zone"}, want: []string{"10.0.0.1:80"}},
+		{name: "no match", tags: []string{"stable"}},
+	}
+	for _, tt := range tests {
+		got := taggedEndpoints(endpoints, tt.tags)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i, e := range got {
+			if e.Address != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
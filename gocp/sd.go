@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sdTargetGroup is a Prometheus http_sd and file_sd target group
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdTargets returns a target group per endpoint of the registry, labeled with
+// __meta_goc_service, node, datacenter, provider and tags in the ,tag1,tag2, form.
+// A non empty tag keeps only the endpoints having that tag.
+func sdTargets(snapshot *RegistrySnapshot, tag string, datacenter string) []*sdTargetGroup {
+	services := make([]string, 0, len(snapshot.Catalog))
+	for service := range snapshot.Catalog {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	groups := make([]*sdTargetGroup, 0)
+	for _, service := range services {
+		for _, e := range snapshot.Catalog[service] {
+			if tag != "" {
+				if _, ok := tagValue(e.Tags, tag); !ok {
+					continue
+				}
+			}
+			labels := map[string]string{
+				"__meta_goc_service":  service,
+				"__meta_goc_node":     e.Node,
+				"__meta_goc_provider": snapshot.Sources[service],
+				"__meta_goc_tags":     "," + strings.Join(e.Tags, ",") + ",",
+			}
+			dc := e.Datacenter
+			if dc == "" && snapshot.Sources[service] == providerConsul {
+				dc = datacenter
+			}
+			if dc != "" {
+				labels["__meta_goc_datacenter"] = dc
+			}
+			groups = append(groups, &sdTargetGroup{Targets: []string{e.Address}, Labels: labels})
+		}
+	}
+	return groups
+}
+
+// SDFile writes the registry as a Prometheus file_sd file after each change
+type SDFile struct {
+	Path       string
+	Tag        string
+	Datacenter string
+	Registry   *Registry
+	stopChan   chan struct{}
+}
+
+// NewSDFile creates the file_sd writer, it returns nil when no file is configured
+func NewSDFile(config *Config, registry *Registry) *SDFile {
+	if config.SDFile == "" {
+		return nil
+	}
+	return &SDFile{
+		Path:       config.SDFile,
+		Tag:        config.SDTag,
+		Datacenter: config.ConsulDatacenter,
+		Registry:   registry,
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// Start writes the current registry and rewrites it on each update
+func (f *SDFile) Start() {
+	updates := f.Registry.Subscribe()
+	defer f.Registry.Unsubscribe(updates)
+	f.write(f.Registry.Snapshot())
+	for {
+		select {
+		case <-f.stopChan:
+			return
+		case snapshot := <-updates:
+			f.write(snapshot)
+		}
+	}
+}
+
+// Stop ends the file_sd writer
+func (f *SDFile) Stop() {
+	close(f.stopChan)
+}
+
+func (f *SDFile) write(snapshot *RegistrySnapshot) {
+	groups := sdTargets(snapshot, f.Tag, f.Datacenter)
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		log.Errorf("Prometheus file_sd encoding error %s", err.Error())
+		return
+	}
+	if err := writeFileAtomic(f.Path, data, 0644); err != nil {
+		log.Errorf("Prometheus file_sd write error %s", err.Error())
+		return
+	}
+	log.Debugf("Prometheus file_sd %s written with %v targets for registry version %v", f.Path, len(groups), snapshot.Version)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	unrender "github.com/unrolled/render"
+)
+
+// testSDRegistry holds Consul services with and without a datacenter and a file service
+func testSDRegistry() *Registry {
+	registry := NewRegistry([]string{providerConsul, providerFile})
+	registry.Update(providerConsul, map[string][]Endpoint{
+		"web": {
+			{Address: "10.0.0.1:80", Node: "n1", Datacenter: "dc2", Tags: []string{"goc.metrics", "v1"}},
+			{Address: "10.0.0.2:80", Node: "n2", Tags: []string{"v1"}},
+		},
+	})
+	registry.Update(providerFile, map[string][]Endpoint{
+		"api": {{Address: "10.0.1.1:8080", Tags: []string{"goc.metrics=/metrics"}}},
+	})
+	return registry
+}
+
+func TestSDTargets(t *testing.T) {
+	snapshot := testSDRegistry().Snapshot()
+	api := &sdTargetGroup{Targets: []string{"10.0.1.1:8080"}, Labels: map[string]string{
+		"__meta_goc_service": "api", "__meta_goc_node": "", "__meta_goc_provider": providerFile, "__meta_goc_tags": ",goc.metrics=/metrics,",
+	}}
+	web1 := &sdTargetGroup{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{
+		"__meta_goc_service": "web", "__meta_goc_node": "n1", "__meta_goc_provider": providerConsul, "__meta_goc_tags": ",goc.metrics,v1,",
+		"__meta_goc_datacenter": "dc2",
+	}}
+	web2 := &sdTargetGroup{Targets: []string{"10.0.0.2:80"}, Labels: map[string]string{
+		"__meta_goc_service": "web", "__meta_goc_node": "n2", "__meta_goc_provider": providerConsul, "__meta_goc_tags": ",v1,",
+		"__meta_goc_datacenter": "dc1",
+	}}
+	web2NoDC := &sdTargetGroup{Targets: web2.Targets, Labels: map[string]string{}}
+	for k, v := range web2.Labels {
+		if k != "__meta_goc_datacenter" {
+			web2NoDC.Labels[k] = v
+		}
+	}
+
+	tests := []struct {
+		name       string
+		tag        string
+		datacenter string
+		groups     []*sdTargetGroup
+	}{
+		{name: "all services ordered", datacenter: "dc1", groups: []*sdTargetGroup{api, web1, web2}},
+		{name: "unknown datacenter", groups: []*sdTargetGroup{api, web1, web2NoDC}},
+		{name: "tag filter", tag: "goc.metrics", datacenter: "dc1", groups: []*sdTargetGroup{api, web1}},
+		{name: "tag without value", tag: "v1", datacenter: "dc1", groups: []*sdTargetGroup{web1, web2}},
+		{name: "no match", tag: "missing", groups: []*sdTargetGroup{}},
+	}
+	for _, tt := range tests {
+		groups := sdTargets(snapshot, tt.tag, tt.datacenter)
+		if !reflect.DeepEqual(groups, tt.groups) {
+			got, _ := json.Marshal(groups)
+			want, _ := json.Marshal(tt.groups)
+			t.Errorf("%s: targets %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestSDHandler(t *testing.T) {
+	proxy := &ReverseProxy{Config: &Config{SDTag: "goc.metrics", ConsulDatacenter: "dc1"}, Registry: testSDRegistry()}
+	handler := proxy.sdHandlerFunc(unrender.New())
+	tests := []struct {
+		target  string
+		targets []string
+	}{
+		{target: "/_/sd", targets: []string{"10.0.1.1:8080", "10.0.0.1:80"}},
+		{target: "/_/sd?tag=v1", targets: []string{"10.0.0.1:80", "10.0.0.2:80"}},
+		{target: "/_/sd?tag=", targets: []string{"10.0.1.1:8080", "10.0.0.1:80", "10.0.0.2:80"}},
+		{target: "/_/sd?tag=missing", targets: []string{}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json; charset=UTF-8" {
+			t.Errorf("%s: status %v content type %s", tt.target, w.Code, w.Header().Get("Content-Type"))
+		}
+		// the http_sd format is a JSON array of objects with targets and labels
+		var groups []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &groups); err != nil {
+			t.Fatalf("%s: body %s: %v", tt.target, w.Body.String(), err)
+		}
+		targets := []string{}
+		for _, group := range groups {
+			if len(group) != 2 || group["labels"] == nil {
+				t.Errorf("%s: group %v", tt.target, group)
+			}
+			for _, target := range group["targets"].([]interface{}) {
+				targets = append(targets, target.(string))
+			}
+		}
+		if !reflect.DeepEqual(targets, tt.targets) {
+			t.Errorf("%s: targets %v, want %v", tt.target, targets, tt.targets)
+		}
+	}
+}
+
+func TestSDFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "targets.json")
+	ioutil.WriteFile(path, []byte("stale"), 0600)
+	registry := testSDRegistry()
+	sd := NewSDFile(&Config{SDFile: path, ConsulDatacenter: "dc1"}, registry)
+
+	read := func() []*sdTargetGroup {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var groups []*sdTargetGroup
+		if err := json.Unmarshal(data, &groups); err != nil {
+			t.Fatalf("file_sd %q: %v", data, err)
+		}
+		return groups
+	}
+	sd.write(registry.Snapshot())
+	if groups := read(); !reflect.DeepEqual(groups, sdTargets(registry.Snapshot(), "", "dc1")) {
+		t.Errorf("file_sd groups %+v", groups)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Errorf("file_sd mode %v, want 0644", info.Mode().Perm())
+	}
+
+	// the file is rewritten on registry updates
+	go sd.Start()
+	defer sd.Stop()
+	time.Sleep(50 * time.Millisecond)
+	registry.Update(providerFile, map[string][]Endpoint{"api": {{Address: "10.0.1.2:8080"}}})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		groups := read()
+		if len(groups) == 3 && groups[0].Targets[0] == "10.0.1.2:8080" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("file_sd not rewritten: %+v", groups)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the file is replaced by a rename, no temp file is left
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("files %v left in the file_sd directory", files)
+	}
+
+	// a failed rename removes the temp file
+	target := filepath.Join(dir, "dir")
+	os.MkdirAll(filepath.Join(target, "keep"), 0755)
+	failed := NewSDFile(&Config{SDFile: target}, registry)
+	failed.write(registry.Snapshot())
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("files %v left after a failed write", files)
+	}
+}
+
+func TestNewSDFileDisabled(t *testing.T) {
+	if sd := NewSDFile(&Config{}, NewRegistry([]string{providerFile})); sd != nil {
+		t.Errorf("file_sd enabled without a path: %+v", sd)
+	}
+}
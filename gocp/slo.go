@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul_api "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SLO is a service level objective on the proxied requests of a service.
+// A request is good when the proxy does not answer with a 5xx, the service
+// is in the registry and, if Latency is set, when it completes within Latency.
+type SLO struct {
+	Name      string  `yaml:"name" json:"name"`
+	Service   string  `yaml:"service" json:"service"`
+	Objective float64 `yaml:"objective" json:"objective"`
+	Latency   string  `yaml:"latency" json:"latency,omitempty"`
+	Window    string  `yaml:"window" json:"window"`
+	latency   time.Duration
+	window    time.Duration
+}
+
+// sloFile is the SLO definitions format, stored in a file or a Consul KV key,
+// objectives are percentages and windows accept days:
+//
+//	slos:
+//	  - name: billing-fast
+//	    service: billing
+//	    objective: 99.9
+//	    latency: 300ms
+//	    window: 30d
+type sloFile struct {
+	SLOs []*SLO `yaml:"slos"`
+}
+
+// burnWindow is a multi-window burn rate alert, it fires when the burn rate
+// over both the long and the short window exceeds the factor
+type burnWindow struct {
+	Severity string
+	Long     time.Duration
+	Short    time.Duration
+	Factor   float64
+}
+
+// burnWindows are the multi-window, multi burn rate alerts of the Google SRE workbook
+var burnWindows = []burnWindow{
+	{"page", time.Hour, 5 * time.Minute, 14.4},
+	{"page", 6 * time.Hour, 30 * time.Minute, 6},
+	{"ticket", 24 * time.Hour, 2 * time.Hour, 3},
+	{"ticket", 72 * time.Hour, 6 * time.Hour, 1},
+}
+
+const (
+	// the minute buckets cover the longest burn rate window
+	sloMinuteBuckets = 72 * 60
+	// maxSLOWindow bounds the hour buckets of the SLO window
+	maxSLOWindow = 90 * 24 * time.Hour
+)
+
+// sloBucket counts the round trips of a time slot
+type sloBucket struct {
+	slot  int64
+	total uint64
+	good  uint64
+}
+
+// sloTracker counts the good and total round trips of an SLO in minute buckets
+// for the burn rate windows and hour buckets for the SLO window
+type sloTracker struct {
+	SLO     *SLO
+	mutex   sync.Mutex
+	minutes []sloBucket
+	hours   []sloBucket
+}
+
+func newSLOTracker(slo *SLO) *sloTracker {
+	return &sloTracker{
+		SLO:     slo,
+		minutes: make([]sloBucket, sloMinuteBuckets),
+		hours:   make([]sloBucket, int(slo.window/time.Hour)),
+	}
+}
+
+func (t *sloTracker) record(now time.Time, duration time.Duration, failed bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	good := !failed && (t.SLO.latency == 0 || duration <= t.SLO.latency)
+	addToBucket(t.minutes, now.Unix()/60, good)
+	addToBucket(t.hours, now.Unix()/3600, good)
+}
+
+func addToBucket(buckets []sloBucket, slot int64, good bool) {
+	b := &buckets[slot%int64(len(buckets))]
+	if b.slot != slot {
+		*b = sloBucket{slot: slot}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// count returns the good and total round trips of the last window
+func (t *sloTracker) count(now time.Time, window time.Duration) (good uint64, total uint64) {
+	buckets, size, slot := t.minutes, int64(time.Minute/time.Second), now.Unix()/60
+	if window > sloMinuteBuckets*time.Minute {
+		buckets, size, slot = t.hours, int64(time.Hour/time.Second), now.Unix()/3600
+	}
+	n := int64(window/time.Second) / size
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for s := slot - n + 1; s <= slot; s++ {
+		b := buckets[s%int64(len(buckets))]
+		if b.slot == s {
+			good += b.good
+			total += b.total
+		}
+	}
+	return good, total
+}
+
+// SLOStatus is the SLO state served on /_/slo
+type SLOStatus struct {
+	*SLO
+	// SLI is the good round trips ratio by window, 1 when there was no round trip
+	SLI map[string]float64 `json:"sli"`
+	// BurnRate is the error budget consumption rate by window, 1 spends the budget in exactly the SLO window
+	BurnRate map[string]float64 `json:"burn_rate"`
+	// BudgetRemaining is the share of the error budget left in the SLO window, negative once exhausted
+	BudgetRemaining float64 `json:"budget_remaining"`
+	// Alerts are the severities of the firing burn rate alerts
+	Alerts []string `json:"alerts"`
+}
+
+func (t *sloTracker) status(now time.Time) *SLOStatus {
+	t.mutex.Lock()
+	slo := t.SLO
+	t.mutex.Unlock()
+	budget := 1 - slo.Objective/100
+	s := &SLOStatus{SLO: slo, SLI: make(map[string]float64), BurnRate: make(map[string]float64), Alerts: []string{}}
+	burn := func(window time.Duration) float64 {
+		key := formatWindow(window)
+		if rate, ok := s.BurnRate[key]; ok {
+			return rate
+		}
+		good, total := t.count(now, window)
+		sli := 1.0
+		if total > 0 {
+			sli = float64(good) / float64(total)
+		}
+		s.SLI[key] = sli
+		s.BurnRate[key] = (1 - sli) / budget
+		return s.BurnRate[key]
+	}
+
+	s.BudgetRemaining = 1 - burn(slo.window)
+	firing := make(map[string]bool)
+	for _, w := range burnWindows {
+		long, short := burn(w.Long), burn(w.Short)
+		if long > w.Factor && short > w.Factor && !firing[w.Severity] {
+			firing[w.Severity] = true
+			s.Alerts = append(s.Alerts, w.Severity)
+		}
+	}
+	return s
+}
+
+// SLOTable tracks the SLOs loaded from a file or a Consul KV key
+// with the requests recorded by the proxy handler
+type SLOTable struct {
+	// trackers by service
+	trackers atomic.Value
+	source   *watchedSource
+	mutex    sync.Mutex
+
+	objectiveDesc *prometheus.Desc
+	sliDesc       *prometheus.Desc
+	burnDesc      *prometheus.Desc
+	budgetDesc    *prometheus.Desc
+	alertDesc     *prometheus.Desc
+}
+
+// NewSLOTable creates the SLO table, it returns nil when no SLO source is configured
+func NewSLOTable(config *Config, client *consul_api.Client) (*SLOTable, error) {
+	if config.SLOFile == "" && config.SLOKVKey == "" {
+		return nil, nil
+	}
+	if config.SLOFile != "" && config.SLOKVKey != "" {
+		return nil, fmt.Errorf("SLOFile and SLOKVKey are mutually exclusive")
+	}
+	labels := []string{"slo", "service"}
+	t := &SLOTable{
+		objectiveDesc: prometheus.NewDesc("goc_proxy_slo_objective", "The SLO objective ratio.", labels, nil),
+		sliDesc:       prometheus.NewDesc("goc_proxy_slo_sli_ratio", "The ratio of good round trips by window.", append(labels, "window"), nil),
+		burnDesc:      prometheus.NewDesc("goc_proxy_slo_burn_rate", "The error budget burn rate by window, 1 spends the budget in exactly the SLO window.", append(labels, "window"), nil),
+		budgetDesc:    prometheus.NewDesc("goc_proxy_slo_error_budget_remaining", "The share of the error budget left in the SLO window.", labels, nil),
+		alertDesc:     prometheus.NewDesc("goc_proxy_slo_burn_alert", "Multi-window burn rate alert status by severity. Has two possible values: 1 - firing, 0 - inactive.", append(labels, "severity"), nil),
+	}
+	t.trackers.Store(make(map[string][]*sloTracker))
+	t.source = newWatchedSource(config.SLOFile, config.SLOFileInterval, config.SLOKVKey, client, t.apply)
+	return t, nil
+}
+
+// Record counts a request of the service, failed stands for a 5xx or a service missing from the registry
+func (t *SLOTable) Record(service string, duration time.Duration, failed bool) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	for _, tracker := range t.trackers.Load().(map[string][]*sloTracker)[service] {
+		tracker.record(now, duration, failed)
+	}
+}
+
+// SLOs returns the SLO definitions ordered by name
+func (t *SLOTable) SLOs() []*SLO {
+	slos := []*SLO{}
+	if t == nil {
+		return slos
+	}
+	for _, trackers := range t.trackers.Load().(map[string][]*sloTracker) {
+		for _, tracker := range trackers {
+			tracker.mutex.Lock()
+			slos = append(slos, tracker.SLO)
+			tracker.mutex.Unlock()
+		}
+	}
+	sort.Slice(slos, func(i, j int) bool { return slos[i].Name < slos[j].Name })
+	return slos
+}
+
+// Status returns the state of all SLOs ordered by name
+func (t *SLOTable) Status() []*SLOStatus {
+	statuses := []*SLOStatus{}
+	if t == nil {
+		return statuses
+	}
+	now := time.Now()
+	for _, trackers := range t.trackers.Load().(map[string][]*sloTracker) {
+		for _, tracker := range trackers {
+			statuses = append(statuses, tracker.status(now))
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Start loads the SLOs and watches their source for changes
+func (t *SLOTable) Start() {
+	t.source.Start()
+}
+
+// Stop ends the SLO source watch
+func (t *SLOTable) Stop() {
+	t.source.Stop()
+}
+
+// apply replaces the SLOs, the counts of an SLO are kept when its service, latency and window are unchanged.
+// An invalid definition is ignored and the last good one is kept.
+func (t *SLOTable) apply(source string, data []byte) {
+	slos, err := parseSLOs(data)
+	if err != nil {
+		log.Errorf("SLO definitions from %s are invalid, keeping the last definitions: %s", source, err.Error())
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	current := make(map[string]*sloTracker)
+	for _, trackers := range t.trackers.Load().(map[string][]*sloTracker) {
+		for _, tracker := range trackers {
+			current[tracker.SLO.Name] = tracker
+		}
+	}
+	next := make(map[string][]*sloTracker)
+	for _, slo := range slos {
+		tracker, ok := current[slo.Name]
+		if ok && tracker.SLO.Service == slo.Service && tracker.SLO.latency == slo.latency && tracker.SLO.window == slo.window {
+			// the objective only changes the budget, the trackers are read under their lock
+			tracker.mutex.Lock()
+			tracker.SLO = slo
+			tracker.mutex.Unlock()
+		} else {
+			tracker = newSLOTracker(slo)
+		}
+		next[slo.Service] = append(next[slo.Service], tracker)
+	}
+	t.trackers.Store(next)
+	log.Infof("SLO definitions loaded from %s with %v SLOs", source, len(slos))
+}
+
+// parseSLOs parses and validates YAML or JSON SLO definitions
+func parseSLOs(data []byte) ([]*SLO, error) {
+	var file sloFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i, slo := range file.SLOs {
+		if slo == nil || slo.Service == "" {
+			return nil, fmt.Errorf("SLO %v has no service", i)
+		}
+		if slo.Name == "" {
+			slo.Name = fmt.Sprintf("%s-%v", slo.Service, i)
+		}
+		if names[slo.Name] {
+			return nil, fmt.Errorf("SLO %s is defined twice", slo.Name)
+		}
+		names[slo.Name] = true
+		if slo.Objective <= 0 || slo.Objective >= 100 {
+			return nil, fmt.Errorf("SLO %s objective must be a percentage between 0 and 100 excluded", slo.Name)
+		}
+		if slo.Latency != "" {
+			latency, err := time.ParseDuration(slo.Latency)
+			if err != nil || latency <= 0 {
+				return nil, fmt.Errorf("SLO %s latency is invalid", slo.Name)
+			}
+			slo.latency = latency
+		}
+		if slo.Window == "" {
+			slo.Window = "30d"
+		}
+		window, err := parseWindow(slo.Window)
+		if err != nil || window < time.Hour || window > maxSLOWindow || window%time.Hour != 0 {
+			return nil, fmt.Errorf("SLO %s window must be a whole number of hours between 1h and 90d", slo.Name)
+		}
+		slo.window = window
+	}
+	return file.SLOs, nil
+}
+
+// parseWindow parses a duration accepting a days suffix, e.g. 30d
+func parseWindow(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// formatWindow formats a window as 5m, 6h or 30d
+func formatWindow(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%vd", int64(d/(24*time.Hour)))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%vh", int64(d/time.Hour))
+	}
+	return fmt.Sprintf("%vm", int64(d/time.Minute))
+}
+
+// Describe implements prometheus.Collector
+func (t *SLOTable) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.objectiveDesc
+	ch <- t.sliDesc
+	ch <- t.burnDesc
+	ch <- t.budgetDesc
+	ch <- t.alertDesc
+}
+
+// Collect implements prometheus.Collector, the SLO metrics are computed on scrape
+func (t *SLOTable) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range t.Status() {
+		ch <- prometheus.MustNewConstMetric(t.objectiveDesc, prometheus.GaugeValue, s.Objective/100, s.Name, s.Service)
+		for window, sli := range s.SLI {
+			ch <- prometheus.MustNewConstMetric(t.sliDesc, prometheus.GaugeValue, sli, s.Name, s.Service, window)
+			ch <- prometheus.MustNewConstMetric(t.burnDesc, prometheus.GaugeValue, s.BurnRate[window], s.Name, s.Service, window)
+		}
+		ch <- prometheus.MustNewConstMetric(t.budgetDesc, prometheus.GaugeValue, s.BudgetRemaining, s.Name, s.Service)
+		for _, severity := range []string{"page", "ticket"} {
+			firing := 0.0
+			for _, alert := range s.Alerts {
+				if alert == severity {
+					firing = 1
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(t.alertDesc, prometheus.GaugeValue, firing, s.Name, s.Service, severity)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sloNow is the fake clock of the SLO tests
+var sloNow = time.Date(2026, 1, 1, 12, 0, 30, 0, time.UTC)
+
+func testSLOTracker(t *testing.T, definition string) *sloTracker {
+	slos, err := parseSLOs([]byte(definition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSLOTracker(slos[0])
+}
+
+// recordN records total round trips at the time, the first failed ones failing
+func recordN(tracker *sloTracker, at time.Time, total int, failed int, duration time.Duration) {
+	for i := 0; i < total; i++ {
+		tracker.record(at, duration, i < failed)
+	}
+}
+
+func TestSLOTrackerBucketRollover(t *testing.T) {
+	tracker := testSLOTracker(t, "slos: [{service: echo, objective: 99, window: 7d}]")
+	recordN(tracker, sloNow, 2, 1, 0)
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		window time.Duration
+		good   uint64
+		total  uint64
+	}{
+		{name: "same minute", now: sloNow, window: 5 * time.Minute, good: 1, total: 2},
+		{name: "in the short window", now: sloNow.Add(4 * time.Minute), window: 5 * time.Minute, good: 1, total: 2},
+		{name: "out of the short window", now: sloNow.Add(5 * time.Minute), window: 5 * time.Minute, good: 0, total: 0},
+		{name: "minute bucket reused", now: sloNow.Add(72 * time.Hour), window: time.Hour, good: 0, total: 0},
+		{name: "in the SLO window", now: sloNow.Add(6 * 24 * time.Hour), window: 7 * 24 * time.Hour, good: 1, total: 2},
+		{name: "hour bucket reused", now: sloNow.Add(7 * 24 * time.Hour), window: 7 * 24 * time.Hour, good: 0, total: 0},
+	}
+	for _, tt := range tests {
+		good, total := tracker.count(tt.now, tt.window)
+		if good != tt.good || total != tt.total {
+			t.Errorf("%s: good %v total %v, want %v %v", tt.name, good, total, tt.good, tt.total)
+		}
+	}
+
+	// a round trip in a reused bucket drops the counts of the previous slot
+	later := sloNow.Add(72 * time.Hour)
+	recordN(tracker, later, 1, 0, 0)
+	if good, total := tracker.count(later, time.Minute); good != 1 || total != 1 {
+		t.Errorf("reused minute bucket good %v total %v, want 1 1", good, total)
+	}
+	if good, total := tracker.count(later, 7*24*time.Hour); good != 2 || total != 3 {
+		t.Errorf("SLO window good %v total %v, want 2 3", good, total)
+	}
+}
+
+func TestSLOTrackerStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		slo    string
+		record func(tracker *sloTracker)
+		burn   map[string]float64
+		sli    map[string]float64
+		budget float64
+		alerts []string
+	}{
+		{
+			name:   "no traffic",
+			slo:    "slos: [{service: echo, objective: 99}]",
+			record: func(tracker *sloTracker) {},
+			burn:   map[string]float64{"5m": 0, "1h": 0, "30d": 0},
+			sli:    map[string]float64{"5m": 1, "30d": 1},
+			budget: 1,
+		},
+		{
+			name: "recent errors fire both severities",
+			slo:  "slos: [{service: echo, objective: 99}]",
+			record: func(tracker *sloTracker) {
+				recordN(tracker, sloNow.Add(-time.Minute), 100, 20, 0)
+			},
+			burn:   map[string]float64{"5m": 20, "1h": 20, "3d": 20, "30d": 20},
+			sli:    map[string]float64{"5m": 0.8},
+			budget: -19,
+			alerts: []string{"page", "ticket"},
+		},
+		{
+			name: "older errors only fire the ticket",
+			slo:  "slos: [{service: echo, objective: 99}]",
+			record: func(tracker *sloTracker) {
+				recordN(tracker, sloNow.Add(-3*time.Hour), 100, 20, 0)
+				recordN(tracker, sloNow.Add(-time.Minute), 100, 0, 0)
+			},
+			burn:   map[string]float64{"5m": 0, "1h": 0, "2h": 0, "6h": 10, "3d": 10},
+			budget: -9,
+			alerts: []string{"ticket"},
+		},
+		{
+			name: "short window alone does not fire",
+			slo:  "slos: [{service: echo, objective: 99}]",
+			record: func(tracker *sloTracker) {
+				recordN(tracker, sloNow.Add(-50*time.Minute), 1000, 0, 0)
+				recordN(tracker, sloNow, 10, 2, 0)
+			},
+			burn:   map[string]float64{"5m": 20},
+			budget: 1 - 2.0/1010/0.01,
+			alerts: []string{},
+		},
+		{
+			name: "slow round trips spend the budget",
+			slo:  "slos: [{service: echo, objective: 99.5, latency: 300ms, window: 1h}]",
+			record: func(tracker *sloTracker) {
+				recordN(tracker, sloNow, 999, 0, 100*time.Millisecond)
+				tracker.record(sloNow, 301*time.Millisecond, false)
+			},
+			burn:   map[string]float64{"1h": 0.2},
+			sli:    map[string]float64{"1h": 0.999},
+			budget: 0.8,
+			alerts: []string{},
+		},
+	}
+	for _, tt := range tests {
+		tracker := testSLOTracker(t, tt.slo)
+		tt.record(tracker)
+		s := tracker.status(sloNow)
+		for window, want := range tt.burn {
+			if got, ok := s.BurnRate[window]; !ok || math.Abs(got-want) > 1e-9 {
+				t.Errorf("%s: burn rate %s %v, want %v", tt.name, window, got, want)
+			}
+		}
+		for window, want := range tt.sli {
+			if got := s.SLI[window]; math.Abs(got-want) > 1e-9 {
+				t.Errorf("%s: SLI %s %v, want %v", tt.name, window, got, want)
+			}
+		}
+		if math.Abs(s.BudgetRemaining-tt.budget) > 1e-9 {
+			t.Errorf("%s: budget remaining %v, want %v", tt.name, s.BudgetRemaining, tt.budget)
+		}
+		if tt.alerts != nil && strings.Join(s.Alerts, ",") != strings.Join(tt.alerts, ",") {
+			t.Errorf("%s: alerts %v, want %v", tt.name, s.Alerts, tt.alerts)
+		}
+	}
+}
+
+func TestSLOTableApplyKeepsTrackers(t *testing.T) {
+	table := &SLOTable{}
+	table.trackers.Store(make(map[string][]*sloTracker))
+	table.apply("test", []byte("slos: [{name: fast, service: echo, objective: 99, latency: 300ms}, {name: up, service: echo, objective: 99}]"))
+	if len(table.SLOs()) != 2 {
+		t.Fatalf("%v SLOs loaded, want 2", len(table.SLOs()))
+	}
+	table.Record("echo", 0, true)
+	table.Record("other", 0, true)
+
+	total := func(name string) uint64 {
+		for _, trackers := range table.trackers.Load().(map[string][]*sloTracker) {
+			for _, tracker := range trackers {
+				if tracker.SLO.Name == name {
+					_, total := tracker.count(time.Now(), time.Hour)
+					return total
+				}
+			}
+		}
+		t.Fatalf("SLO %s not loaded", name)
+		return 0
+	}
+	tests := []struct {
+		name       string
+		definition string
+		fast       uint64
+		up         uint64
+	}{
+		{
+			name:       "objective change keeps the counts",
+			definition: "slos: [{name: fast, service: echo, objective: 99.9, latency: 300ms}, {name: up, service: echo, objective: 99}]",
+			fast:       1, up: 1,
+		},
+		{
+			name:       "invalid definitions keep the last ones",
+			definition: "slos: [{name: fast, service: echo, objective: 100}]",
+			fast:       1, up: 1,
+		},
+		{
+			name:       "latency change resets the counts",
+			definition: "slos: [{name: fast, service: echo, objective: 99.9, latency: 200ms}, {name: up, service: echo, objective: 99}]",
+			fast:       0, up: 1,
+		},
+		{
+			name:       "window change resets the counts",
+			definition: "slos: [{name: fast, service: echo, objective: 99.9, latency: 200ms}, {name: up, service: echo, objective: 99, window: 7d}]",
+			fast:       0, up: 0,
+		},
+	}
+	for _, tt := range tests {
+		table.apply("test", []byte(tt.definition))
+		if got := total("fast"); got != tt.fast {
+			t.Errorf("%s: fast total %v, want %v", tt.name, got, tt.fast)
+		}
+		if got := total("up"); got != tt.up {
+			t.Errorf("%s: up total %v, want %v", tt.name, got, tt.up)
+		}
+	}
+	for _, slo := range table.SLOs() {
+		if slo.Name == "fast" && slo.Objective != 99.9 {
+			t.Errorf("fast objective %v, want 99.9", slo.Objective)
+		}
+	}
+}
+
+func TestParseSLOs(t *testing.T) {
+	tests := []struct {
+		name       string
+		definition string
+		err        string
+	}{
+		{name: "valid", definition: "slos: [{name: fast, service: echo, objective: 99.9, latency: 300ms, window: 30d}]"},
+		{name: "json", definition: `{"slos": [{"service": "echo", "objective": 99, "window": "12h"}]}`},
+		{name: "no service", definition: "slos: [{name: fast, objective: 99}]", err: "has no service"},
+		{name: "duplicate", definition: "slos: [{name: a, service: echo, objective: 99}, {name: a, service: echo, objective: 99}]", err: "defined twice"},
+		{name: "zero objective", definition: "slos: [{service: echo, objective: 0}]", err: "objective"},
+		{name: "full objective", definition: "slos: [{service: echo, objective: 100}]", err: "objective"},
+		{name: "ratio objective", definition: "slos: [{service: echo, objective: -0.99}]", err: "objective"},
+		{name: "bad latency", definition: "slos: [{service: echo, objective: 99, latency: fast}]", err: "latency"},
+		{name: "negative latency", definition: "slos: [{service: echo, objective: 99, latency: -1s}]", err: "latency"},
+		{name: "bad window", definition: "slos: [{service: echo, objective: 99, window: month}]", err: "window"},
+		{name: "short window", definition: "slos: [{service: echo, objective: 99, window: 30m}]", err: "window"},
+		{name: "long window", definition: "slos: [{service: echo, objective: 99, window: 91d}]", err: "window"},
+		{name: "partial hour window", definition: "slos: [{service: echo, objective: 99, window: 90m}]", err: "window"},
+		{name: "unknown field", definition: "slos: [{service: echo, objective: 99, target: 1}]", err: "target"},
+	}
+	for _, tt := range tests {
+		slos, err := parseSLOs([]byte(tt.definition))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+		if slos != nil {
+			t.Errorf("%s: SLOs returned with an error", tt.name)
+		}
+	}
+
+	slos, _ := parseSLOs([]byte("slos: [{service: echo, objective: 99}]"))
+	if slos[0].Name != "echo-0" || slos[0].Window != "30d" || slos[0].window != 30*24*time.Hour {
+		t.Errorf("defaults %+v", slos[0])
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+// watchedSource loads a document from a file or a Consul KV key
+// and hands it to apply each time it changes
+type watchedSource struct {
+	File     string
+	Interval time.Duration
+	KVKey    string
+	Client   *consul_api.Client
+	apply    func(source string, data []byte)
+	modTime  time.Time
+	size     int64
+	stopChan chan struct{}
+}
+
+func newWatchedSource(file string, interval int, kvKey string, client *consul_api.Client, apply func(string, []byte)) *watchedSource {
+	return &watchedSource{
+		File:     file,
+		Interval: time.Duration(interval) * time.Second,
+		KVKey:    kvKey,
+		Client:   client,
+		apply:    apply,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// Start watches the KV key with a blocking query or polls the file
+func (s *watchedSource) Start() {
+	if s.KVKey != "" {
+		watchQuery(s.Client, "/v1/kv/"+s.KVKey, s.stopChan,
+			func() interface{} { return &[]*consul_api.KVPair{} },
+			func(idx uint64, data interface{}) {
+				pairs := *data.(*[]*consul_api.KVPair)
+				if len(pairs) == 0 {
+					return
+				}
+				s.apply("Consul KV "+s.KVKey, pairs[0].Value)
+			}, nil)
+		return
+	}
+
+	s.reload()
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case <-ticker.C:
+			s.reload()
+		}
+	}
+}
+
+// Stop ends the source watch
+func (s *watchedSource) Stop() {
+	close(s.stopChan)
+}
+
+// reload applies the file if its size or modification time changed
+func (s *watchedSource) reload() {
+	info, err := os.Stat(s.File)
+	if err != nil {
+		log.Warnf("File %s error %s", s.File, err.Error())
+		return
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return
+	}
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	data, err := ioutil.ReadFile(s.File)
+	if err != nil {
+		log.Warnf("File %s error %s", s.File, err.Error())
+		return
+	}
+	s.apply(s.File, data)
+}
@@ -4,133 +4,358 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	consul_api "github.com/hashicorp/consul/api"
-	watch "github.com/hashicorp/consul/watch"
 )
 
 // ConsulSync syncs Consul catalog and service endpoints changes
 // with the local registry
 type RegistrySync struct {
-	Registry       *Registry
-	Client         *consul_api.Client
-	Config         *consul_api.Config
-	CatalogWatcher *watch.WatchPlan
-	Watchers       map[string]*watch.WatchPlan
-	mutex          sync.Mutex
+	Registry    *Registry
+	Client      *consul_api.Client
+	Config      *consul_api.Config
+	ProxyConfig *Config
+	Expose      *ExposeRules
+	Health      *HealthPolicy
+	Watchers    map[string]chan struct{}
+	// endpoints by routed service name for each Consul service
+	services map[string]map[string][]Endpoint
+	// Consul index of the endpoints of each Consul service, a full sync keeps newer watcher results
+	indexes map[string]uint64
+	// node status series for each Consul service
+	nodes map[string]map[nodeStatus]float64
+	// catalog tags of the Consul services, sidecars are exposed with the tags of their destination
+	catalog      map[string][]string
+	publishTimer *time.Timer
+	pendingSince time.Time
+	stopChan     chan struct{}
+	mutex        sync.Mutex
+}
+
+// sidecarSuffix is appended by Consul to the name of the sidecar services registered along their destination
+const sidecarSuffix = "-sidecar-proxy"
+
+// nodeStatus is the label set of a proxy_service_node_status series
+type nodeStatus struct {
+	service string
+	node    string
+	address string
+}
+
+// serviceEntry is the health service entry extended with
+// the Connect fields missing from the Consul API client
+type serviceEntry struct {
+	Node *struct {
+		Node       string
+		Datacenter string
+	}
+	Service struct {
+		consul_api.AgentService
+		Meta    map[string]string
+		Kind    string
+		Connect *struct {
+			Native bool
+		}
+		Proxy *struct {
+			DestinationServiceName string
+		}
+	}
+	Checks []*consul_api.HealthCheck
 }
 
 // NewRegistrySync init Consul sync
-func NewRegistrySync() (*RegistrySync, error) {
+func NewRegistrySync(proxyConfig *Config, registry *Registry, client *consul_api.Client, config *consul_api.Config) (*RegistrySync, error) {
 
-	watchers := make(map[string]*watch.WatchPlan)
-	registry := &Registry{}
-	registry.Catalog = make(map[string][]string)
-	registry.Sha = makeSHA(registry.Catalog)
+	watchers := make(map[string]chan struct{})
 
-	config := consul_api.DefaultConfig()
-	client, err := consul_api.NewClient(config)
+	expose, err := NewExposeRules(proxyConfig)
+	if err != nil {
+		return nil, err
+	}
+	health, err := NewHealthPolicy(proxyConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	c := &RegistrySync{
-		Registry: registry,
-		Client:   client,
-		Config:   config,
-		Watchers: watchers,
+		Registry:    registry,
+		Client:      client,
+		Config:      config,
+		ProxyConfig: proxyConfig,
+		Expose:      expose,
+		Health:      health,
+		Watchers:    watchers,
+		services:    make(map[string]map[string][]Endpoint),
+		indexes:     make(map[string]uint64),
+		nodes:       make(map[string]map[nodeStatus]float64),
+		stopChan:    make(chan struct{}),
 	}
 	return c, nil
 }
 
-// Start Consul watchers for service catalog
+// Name returns the provider name
+func (cs *RegistrySync) Name() string {
+	return providerConsul
+}
+
+// Start Consul watchers for service catalog and the periodic full resync.
+// The watchers are started after a first full sync so the registry is never published half populated.
 func (cs *RegistrySync) Start() {
-	wt, _ := watch.Parse(map[string]interface{}{"type": "services"})
-	wt.Handler = cs.handleCatalogChanges
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-	cs.CatalogWatcher = wt
-	go wt.Run(cs.Config.Address)
+	for failures := 1; ; failures++ {
+		err := cs.updateRegistry()
+		if err == nil {
+			break
+		}
+		retry := watchBackoff(failures)
+		log.Warnf("Initial registry sync error %v, retry in %v", err.Error(), retry)
+		select {
+		case <-time.After(retry):
+		case <-cs.stopChan:
+			return
+		}
+	}
+
+	go watchQuery(cs.Client, "/v1/catalog/services", cs.stopChan,
+		func() interface{} { return &map[string][]string{} }, cs.handleCatalogChanges, cs.reportWatch)
+
+	if cs.ProxyConfig.ResyncInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cs.ProxyConfig.ResyncInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cs.stopChan:
+			return
+		case <-ticker.C:
+			log.Debug("Periodic registry resync")
+			if err := cs.updateRegistry(); err != nil {
+				log.Warnf("ConsulSync.UpdateRegistry error %v", err.Error())
+			}
+		}
+	}
 }
 
 // Stop all Consul watchers
 func (cs *RegistrySync) Stop() {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
-	cs.CatalogWatcher.Stop()
+	close(cs.stopChan)
 	for _, w := range cs.Watchers {
-		w.Stop()
+		close(w)
+	}
+	proxy_sync_watchers.Set(0)
+	if cs.publishTimer != nil {
+		cs.publishTimer.Stop()
 	}
 }
 
-// sync local registry with Consul catalog
+// full sync of the local registry with Consul catalog
 func (cs *RegistrySync) updateRegistry() error {
-	registry := make(map[string][]string)
+	start := time.Now()
+	state := make(map[string]map[string][]Endpoint)
+	indexes := make(map[string]uint64)
+	nodes := make(map[string]map[nodeStatus]float64)
 
-	services, _, err := cs.Client.Catalog().Services(nil)
+	catalog, _, err := cs.Client.Catalog().Services(nil)
 	if err != nil {
+		observeSync(providerConsul, syncFull, start, consulErrorCause(err))
 		return err
 	}
+	services := cs.exposedServices(catalog)
 	for service := range services {
-		services, _, err := cs.Client.Health().Service(service, "", false, nil)
+		var entries []*serviceEntry
+		meta, err := cs.Client.Raw().Query("/v1/health/service/"+service, &entries, nil)
 		if err != nil {
+			observeSync(providerConsul, syncFull, start, consulErrorCause(err))
 			return err
 		}
+		state[service], nodes[service] = cs.buildEndpoints(service, entries, catalog)
+		indexes[service] = meta.LastIndex
+	}
 
-		for _, s := range services {
-			// ignore nodes with no address and goc-proxy nodes
-			if s.Service.Address == "" || strings.Contains(s.Service.Service, "goc-proxy") {
-				continue
-			}
-			var critical bool
-			for _, check := range s.Checks {
-				if check.Status == "critical" {
-					log.Debugf("Service %v node %v:%v is being omitted from registry, health is critical.", s.Service, s.Service.Address, s.Service.Port)
-					critical = true
-					proxy_service_node_status.WithLabelValues(s.Service.Service, s.Node.Node, fmt.Sprintf("%v;%v", s.Service.Address, s.Service.Port)).Set(0)
-					break
-				}
-			}
+	// the services are fetched without the lock, merge them with the watcher results received meanwhile
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.mergeServices(state, indexes, nodes)
+	cs.catalog = catalog
+	cs.syncWatchers(services)
+	cs.publish(true)
+	observeSync(providerConsul, syncFull, start, "")
+	return nil
+}
+
+// mergeServices replaces the services endpoints with the full sync results, the endpoints
+// of a service applied by its watcher at a newer Consul index are kept. Must be called with the lock held.
+func (cs *RegistrySync) mergeServices(state map[string]map[string][]Endpoint, indexes map[string]uint64, nodes map[string]map[nodeStatus]float64) {
+	for service := range cs.services {
+		if _, ok := state[service]; !ok {
+			delete(cs.services, service)
+			delete(cs.indexes, service)
+			cs.setNodeStatus(service, nil)
+		}
+	}
+	for service, endpoints := range state {
+		if index, ok := cs.indexes[service]; ok && index > indexes[service] {
+			log.Debugf("Service %v full sync at index %v is older than its watch at index %v", service, indexes[service], index)
+			continue
+		}
+		cs.services[service] = endpoints
+		cs.indexes[service] = indexes[service]
+		cs.setNodeStatus(service, nodes[service])
+	}
+}
 
-			// ignore node if status is critical
-			if critical {
-				continue
+// buildEndpoints returns the healthy and exposed endpoints of a Consul service by routed service name
+// and the health status of its instances, the catalog holds the tags of the sidecars destinations
+func (cs *RegistrySync) buildEndpoints(service string, entries []*serviceEntry, catalog map[string][]string) (map[string][]Endpoint, map[nodeStatus]float64) {
+	registry := make(map[string][]Endpoint)
+	statuses := make(map[nodeStatus]float64)
+	for _, s := range entries {
+		// ignore nodes with no address
+		if s.Service.Address == "" {
+			continue
+		}
+
+		// sidecar proxies are routed and exposed as their destination service
+		name, tags := service, s.Service.Tags
+		if s.Service.Kind == "connect-proxy" && s.Service.Proxy != nil {
+			name = s.Service.Proxy.DestinationServiceName
+			if destination, ok := catalog[name]; ok {
+				tags = destination
 			}
+		}
+		if !cs.Expose.Exposed(name, tags) {
+			continue
+		}
+
+		// ignore node if the health policy excludes it
+		weight, reason := cs.Health.Weight(s.Service.Tags, s.Checks)
+		if weight == 0 {
+			log.Debugf("Service %v node %v:%v is being omitted from registry, health is %s.", s.Service.Service, s.Service.Address, s.Service.Port, reason)
+			statuses[nodeStatus{s.Service.Service, s.Node.Node, fmt.Sprintf("%v:%v", s.Service.Address, s.Service.Port)}] = 0
+			continue
+		}
+
+		// add service node to registry
+		registry[name] = append(registry[name], Endpoint{
+			Address:    fmt.Sprintf("%s:%v", s.Service.Address, s.Service.Port),
+			Node:       s.Node.Node,
+			Datacenter: s.Node.Datacenter,
+			Tags:       s.Service.Tags,
+			Meta:       s.Service.Meta,
+			Weight:     weight,
+			Connect:    s.Service.Kind == "connect-proxy" || (s.Service.Connect != nil && s.Service.Connect.Native),
+		})
+		statuses[nodeStatus{s.Service.Service, s.Node.Node, fmt.Sprintf("%v:%v", s.Service.Address, s.Service.Port)}] = 1
+	}
+	return registry, statuses
+}
 
-			// add service node to registry
-			registry[service] = append(registry[service], fmt.Sprintf("%s:%v", s.Service.Address, s.Service.Port))
-			proxy_service_node_status.WithLabelValues(s.Service.Service, s.Node.Node, fmt.Sprintf("%v:%v", s.Service.Address, s.Service.Port)).Set(1)
+// setNodeStatus updates the node status series of a Consul service and deletes the series
+// of the deregistered instances so their last status does not outlive them.
+// Must be called with the lock held.
+func (cs *RegistrySync) setNodeStatus(service string, statuses map[nodeStatus]float64) {
+	for status := range cs.nodes[service] {
+		if _, ok := statuses[status]; !ok {
+			proxy_service_node_status.DeleteLabelValues(status.service, status.node, status.address)
 		}
 	}
+	for status, value := range statuses {
+		proxy_service_node_status.WithLabelValues(status.service, status.node, status.address).Set(value)
+	}
+	if statuses == nil {
+		delete(cs.nodes, service)
+		return
+	}
+	cs.nodes[service] = statuses
+}
+
+// publish merges the Consul services endpoints and updates the registry, full is set by the full syncs
+// and unset by the watchers. Must be called with the lock held.
+func (cs *RegistrySync) publish(full bool) {
+	if cs.publishTimer != nil {
+		cs.publishTimer.Stop()
+		cs.publishTimer = nil
+	}
+
+	catalog := make(map[string][]Endpoint)
+	for _, routes := range cs.services {
+		for name, endpoints := range routes {
+			catalog[name] = append(catalog[name], endpoints...)
+		}
+	}
+	// native and sidecar endpoints are merged from a map, sort them so the registry Sha is stable
+	for _, endpoints := range catalog {
+		sortEndpoints(endpoints)
+	}
 
 	// update registry only if it changed since last sync
-	sha := makeSHA(registry)
-	if cs.Registry.Sha != sha {
-		cs.Registry.Update(registry)
-		log.Info("Registry has been updated")
-		cs.syncWatchers()
+	update := cs.Registry.UpdateWatch
+	if full {
+		update = cs.Registry.Update
+	}
+	if update(providerConsul, catalog) {
+		log.Infof("Registry has been updated to version %v", cs.Registry.Snapshot().Version)
+	}
+}
+
+// schedulePublish debounces registry updates during bursts of watch events,
+// a pending update is delayed at most 10 times the debounce interval. Must be called with the lock held.
+func (cs *RegistrySync) schedulePublish() {
+	debounce := time.Duration(cs.ProxyConfig.SyncDebounce) * time.Millisecond
+	if debounce <= 0 {
+		cs.publish(false)
+		return
+	}
+	if cs.publishTimer == nil {
+		cs.pendingSince = time.Now()
+		cs.publishTimer = time.AfterFunc(debounce, func() {
+			cs.mutex.Lock()
+			defer cs.mutex.Unlock()
+			cs.publish(false)
+		})
+		return
+	}
+	if time.Since(cs.pendingSince) < 10*debounce {
+		cs.publishTimer.Reset(debounce)
 	}
-	return nil
 }
 
-func (cs *RegistrySync) syncWatchers() {
+// exposedServices filters the Consul catalog with the exposure rules,
+// the catalog tags are the union of the service instances tags.
+// The sidecars of exposed services are kept, their endpoints are filtered once their destination is known.
+func (cs *RegistrySync) exposedServices(catalog map[string][]string) map[string][]string {
+	services := make(map[string][]string, len(catalog))
+	for service, tags := range catalog {
+		parent := strings.TrimSuffix(service, sidecarSuffix)
+		if cs.Expose.Exposed(service, tags) || (parent != service && cs.Expose.Exposed(parent, catalog[parent])) {
+			services[service] = tags
+		} else {
+			log.Debugf("Service %v is not exposed", service)
+		}
+	}
+	return services
+}
 
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-	for sw, wt := range cs.Watchers {
-		_, ok := cs.Registry.Catalog[sw]
+// starts and stops the service watchers, must be called with the lock held
+func (cs *RegistrySync) syncWatchers(services map[string][]string) {
+	for sw, stop := range cs.Watchers {
+		_, ok := services[sw]
 		if !ok {
 			//stop watch since service is gone
-			wt.Stop()
+			close(stop)
 			delete(cs.Watchers, sw)
+			delete(cs.services, sw)
+			delete(cs.indexes, sw)
+			cs.setNodeStatus(sw, nil)
 			log.Infof("Watch for service %v has been removed", sw)
 		}
 	}
 
-	cs.Registry.mutex.RLock()
-	defer cs.Registry.mutex.RUnlock()
-	for service := range cs.Registry.Catalog {
+	for service := range services {
 		_, ok := cs.Watchers[service]
 		if !ok {
 			//start watcher for new service
@@ -138,31 +363,66 @@ func (cs *RegistrySync) syncWatchers() {
 			log.Infof("Watch for service %v has been started", service)
 		}
 	}
+	proxy_sync_watchers.Set(float64(len(cs.Watchers)))
+}
+
+func (cs *RegistrySync) startServiceWatcher(service string) {
+	stop := make(chan struct{})
+	cs.Watchers[service] = stop
+	go watchQuery(cs.Client, "/v1/health/service/"+service, stop,
+		func() interface{} { return &[]*serviceEntry{} },
+		func(idx uint64, data interface{}) {
+			cs.handleServiceChanges(service, stop, idx, *data.(*[]*serviceEntry))
+		}, cs.reportWatch)
 }
 
-func (cs *RegistrySync) startServiceWatcher(service string) error {
-	wt, err := watch.Parse(map[string]interface{}{"type": "service", "service": service})
+// reportWatch records the failed watch queries and the last contact with Consul,
+// the changes are recorded by their handlers
+func (cs *RegistrySync) reportWatch(err error) {
 	if err != nil {
-		return err
+		proxy_sync_errors_total.WithLabelValues(providerConsul, consulErrorCause(err)).Inc()
+		return
 	}
-	wt.Handler = cs.handleServiceChanges
-	cs.Watchers[service] = wt
-	go wt.Run(cs.Config.Address)
-	return nil
+	proxy_sync_last_success_timestamp_seconds.WithLabelValues(providerConsul).Set(float64(time.Now().Unix()))
 }
 
-func (cs *RegistrySync) handleServiceChanges(idx uint64, data interface{}) {
-	log.Info("Service change detected")
-	err := cs.updateRegistry()
-	if err != nil {
-		log.Warnf("ConsulSync.UpdateRegistry error %v", err.Error())
+// applies the health data received by a service watcher at the Consul index to that service alone
+func (cs *RegistrySync) handleServiceChanges(service string, stop chan struct{}, index uint64, entries []*serviceEntry) {
+	log.Debugf("Service %v change detected", service)
+	start := time.Now()
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	// ignore late results from a stopped watcher
+	if cs.Watchers[service] != stop {
+		return
 	}
+	endpoints, statuses := cs.buildEndpoints(service, entries, cs.catalog)
+	cs.services[service] = endpoints
+	cs.indexes[service] = index
+	cs.setNodeStatus(service, statuses)
+	cs.schedulePublish()
+	observeSync(providerConsul, syncWatch, start, "")
 }
 
 func (cs *RegistrySync) handleCatalogChanges(idx uint64, data interface{}) {
 	log.Info("Catalog change detected")
-	err := cs.updateRegistry()
-	if err != nil {
-		log.Warnf("ConsulSync.UpdateRegistry error %v", err.Error())
+	start := time.Now()
+	catalog := *data.(*map[string][]string)
+	services := cs.exposedServices(catalog)
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.catalog = catalog
+	removed := false
+	for service := range cs.services {
+		if _, ok := services[service]; !ok {
+			removed = true
+		}
+	}
+	cs.syncWatchers(services)
+	if removed {
+		cs.schedulePublish()
 	}
+	observeSync(providerConsul, syncWatch, start, "")
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPublishSortsEndpoints(t *testing.T) {
+	registry := NewRegistry([]string{providerConsul})
+	cs := &RegistrySync{Registry: registry, ProxyConfig: &Config{}}
+	cs.services = map[string]map[string][]Endpoint{
+		"web":               {"web": {{Address: "10.0.0.2:80", Node: "n2"}}},
+		"web-sidecar-proxy": {"web": {{Address: "10.0.0.1:21000", Node: "n1", Connect: true}}},
+		"web-native":        {"web": {{Address: "10.0.0.1:80", Node: "n1"}}},
+	}
+	cs.publish(true)
+	sha := registry.Snapshot().Sha
+	for i := 0; i < 20; i++ {
+		if cs.publish(true); registry.Snapshot().Sha != sha {
+			t.Fatal("registry Sha changed between identical syncs")
+		}
+	}
+	endpoints, _ := registry.Lookup("web")
+	for i := 1; i < len(endpoints); i++ {
+		if endpoints[i-1].Address > endpoints[i].Address {
+			t.Fatalf("endpoints are not sorted: %+v", endpoints)
+		}
+	}
+}
+
+func nodeStatusSeries() int {
+	ch := make(chan prometheus.Metric, 100)
+	proxy_service_node_status.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestSetNodeStatusDeletesDeregistered(t *testing.T) {
+	proxy_service_node_status.Reset()
+	cs := &RegistrySync{nodes: make(map[string]map[nodeStatus]float64)}
+	cs.setNodeStatus("web", map[nodeStatus]float64{
+		{"web", "n1", "10.0.0.1:80"}: 1,
+		{"web", "n2", "10.0.0.2:80"}: 0,
+	})
+	if n := nodeStatusSeries(); n != 2 {
+		t.Fatalf("%v node status series, want 2", n)
+	}
+	// the unhealthy instance is deregistered
+	cs.setNodeStatus("web", map[nodeStatus]float64{{"web", "n1", "10.0.0.1:80"}: 1})
+	if n := nodeStatusSeries(); n != 1 {
+		t.Fatalf("%v node status series after deregistration, want 1", n)
+	}
+	// the service is removed from the catalog
+	cs.setNodeStatus("web", nil)
+	if n := nodeStatusSeries(); n != 0 {
+		t.Fatalf("%v node status series after the service removal, want 0", n)
+	}
+}
+
+func TestSidecarsExposedWithDestinationTags(t *testing.T) {
+	expose, err := NewExposeRules(&Config{ExposeMode: exposeTagged, ExposeTag: tagExpose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	health, err := NewHealthPolicy(&Config{HealthPolicy: healthPassing, HealthWarningWeight: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &RegistrySync{Expose: expose, Health: health}
+	catalog := map[string][]string{
+		"web":               {"goc.expose"},
+		"web-sidecar-proxy": nil,
+		"db":                nil,
+		"db-sidecar-proxy":  {"goc.expose"},
+	}
+
+	services := cs.exposedServices(catalog)
+	for _, service := range []string{"web", "web-sidecar-proxy", "db-sidecar-proxy"} {
+		if _, ok := services[service]; !ok {
+			t.Errorf("service %s is not watched", service)
+		}
+	}
+	if _, ok := services["db"]; ok {
+		t.Error("untagged service db is watched")
+	}
+
+	sidecar := func(destination string) *serviceEntry {
+		entry := &serviceEntry{Node: &struct {
+			Node       string
+			Datacenter string
+		}{Node: "n1"}}
+		entry.Service.Address = "10.0.0.1"
+		entry.Service.Port = 21000
+		entry.Service.Kind = "connect-proxy"
+		entry.Service.Proxy = &struct {
+			DestinationServiceName string
+		}{DestinationServiceName: destination}
+		return entry
+	}
+	endpoints, _ := cs.buildEndpoints("web-sidecar-proxy", []*serviceEntry{sidecar("web")}, catalog)
+	if len(endpoints["web"]) != 1 || !endpoints["web"][0].Connect {
+		t.Errorf("sidecar of the tagged service web is not routed: %+v", endpoints)
+	}
+	endpoints, _ = cs.buildEndpoints("db-sidecar-proxy", []*serviceEntry{sidecar("db")}, catalog)
+	if len(endpoints) != 0 {
+		t.Errorf("sidecar of the untagged service db is routed: %+v", endpoints)
+	}
+}
+
+func TestFullSyncKeepsNewerWatchResults(t *testing.T) {
+	expose, err := NewExposeRules(&Config{ExposeMode: exposeAll, ExposeTag: tagExpose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	health, err := NewHealthPolicy(&Config{HealthPolicy: healthPassing, HealthWarningWeight: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &RegistrySync{
+		Registry:    NewRegistry([]string{providerConsul}),
+		ProxyConfig: &Config{},
+		Expose:      expose,
+		Health:      health,
+		Watchers:    map[string]chan struct{}{},
+		services:    make(map[string]map[string][]Endpoint),
+		indexes:     make(map[string]uint64),
+		nodes:       make(map[string]map[nodeStatus]float64),
+	}
+	entry := func(address string) *serviceEntry {
+		e := &serviceEntry{Node: &struct {
+			Node       string
+			Datacenter string
+		}{Node: "n1"}}
+		e.Service.Service = "web"
+		e.Service.Address = address
+		e.Service.Port = 80
+		return e
+	}
+	full := func(index uint64, addresses ...string) (map[string]map[string][]Endpoint, map[string]uint64, map[string]map[nodeStatus]float64) {
+		var entries []*serviceEntry
+		for _, address := range addresses {
+			entries = append(entries, entry(address))
+		}
+		endpoints, statuses := cs.buildEndpoints("web", entries, nil)
+		return map[string]map[string][]Endpoint{"web": endpoints}, map[string]uint64{"web": index},
+			map[string]map[nodeStatus]float64{"web": statuses}
+	}
+	addresses := func() string {
+		var list []string
+		for _, e := range cs.services["web"]["web"] {
+			list = append(list, e.Address)
+		}
+		return strings.Join(list, ",")
+	}
+
+	cs.mergeServices(full(100, "10.0.0.1"))
+	stop := make(chan struct{})
+	cs.Watchers["web"] = stop
+
+	tests := []struct {
+		name      string
+		apply     func()
+		addresses string
+	}{
+		{
+			name: "watch applied",
+			apply: func() {
+				cs.handleServiceChanges("web", stop, 105, []*serviceEntry{entry("10.0.0.1"), entry("10.0.0.2")})
+			},
+			addresses: "10.0.0.1:80,10.0.0.2:80",
+		},
+		{
+			name:      "older full sync ignored",
+			apply:     func() { cs.mergeServices(full(100, "10.0.0.1")) },
+			addresses: "10.0.0.1:80,10.0.0.2:80",
+		},
+		{
+			name:      "same index full sync applied",
+			apply:     func() { cs.mergeServices(full(105, "10.0.0.2")) },
+			addresses: "10.0.0.2:80",
+		},
+		{
+			name:      "newer full sync applied",
+			apply:     func() { cs.mergeServices(full(110, "10.0.0.3")) },
+			addresses: "10.0.0.3:80",
+		},
+		{
+			name:      "watch after a Consul index reset applied",
+			apply:     func() { cs.handleServiceChanges("web", stop, 2, []*serviceEntry{entry("10.0.0.4")}) },
+			addresses: "10.0.0.4:80",
+		},
+		{
+			name:      "late result of a stopped watcher ignored",
+			apply:     func() { cs.handleServiceChanges("web", make(chan struct{}), 200, []*serviceEntry{entry("10.0.0.5")}) },
+			addresses: "10.0.0.4:80",
+		},
+	}
+	for _, tt := range tests {
+		tt.apply()
+		if got := addresses(); got != tt.addresses {
+			t.Errorf("%s: endpoints %s, want %s", tt.name, got, tt.addresses)
+		}
+	}
+
+	// a service missing from the full sync is removed
+	cs.mergeServices(map[string]map[string][]Endpoint{}, map[string]uint64{}, nil)
+	if _, ok := cs.services["web"]; ok {
+		t.Error("removed service kept")
+	}
+	if _, ok := cs.indexes["web"]; ok {
+		t.Error("removed service index kept")
+	}
+}
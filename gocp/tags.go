@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+)
+
+// Consul tags used to configure how goc-proxy routes to a service.
+// Tags are in the form goc.<key>=<value>, the scheme can also be set in the service meta.
+const (
+	tagScheme        = "goc.scheme"
+	tagTLSCA         = "goc.tls.ca"
+	tagTLSCert       = "goc.tls.cert"
+	tagTLSKey        = "goc.tls.key"
+	tagTLSServerName = "goc.tls.servername"
+	tagTLSInsecure   = "goc.tls.insecure"
+	tagProxyProtocol = "goc.proxyprotocol"
+	tagExpose        = "goc.expose"
+	tagHealth        = "goc.health"
+)
+
+// tagValue returns the value of the first key=value tag matching the key
+func tagValue(tags []string, key string) (string, bool) {
+	for _, tag := range tags {
+		if tag == key {
+			return "", true
+		}
+		if strings.HasPrefix(tag, key+"=") {
+			return tag[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+// serviceMeta returns the first value of the meta key set on the service endpoints,
+// Consul meta keys can't contain dots so goc.<key> is also looked up as goc_<key>
+func serviceMeta(endpoints []Endpoint, key string) (string, bool) {
+	alt := strings.Replace(key, ".", "_", -1)
+	for _, e := range endpoints {
+		if v, ok := e.Meta[key]; ok {
+			return v, true
+		}
+		if v, ok := e.Meta[alt]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// serviceTags merges the tags of all service endpoints preserving their order
+func serviceTags(endpoints []Endpoint) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, e := range endpoints {
+		for _, tag := range e.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
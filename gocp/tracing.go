@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// span exporters
+const (
+	exporterOTLP   = "otlp"
+	exporterZipkin = "zipkin"
+)
+
+// trace context propagation formats
+const (
+	propagationW3C = "w3c"
+	propagationB3  = "b3"
+)
+
+const (
+	spanKindServer = "server"
+	spanKindClient = "client"
+	// maximum number of spans sent in one export request
+	spanBatchSize = 512
+)
+
+// Tracer records the proxy server spans and the upstream client spans
+// and exports the sampled ones in batches to the collector
+type Tracer struct {
+	Exporter    string
+	Endpoint    string
+	ServiceName string
+	SampleRate  float64
+	Propagation []string
+	client      *http.Client
+	spans       chan *Span
+	stopChan    chan struct{}
+	done        chan struct{}
+}
+
+// Span is a timed operation of a trace, IDs are hex encoded
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Kind       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Status     int
+	Error      string
+	Sampled    bool
+	tracer     *Tracer
+}
+
+// NewTracer creates the tracer from config, it returns nil when tracing is disabled
+func NewTracer(config *Config) (*Tracer, error) {
+	if config.TracingExporter == "" {
+		return nil, nil
+	}
+	switch config.TracingExporter {
+	case exporterOTLP, exporterZipkin:
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s", config.TracingExporter)
+	}
+	if config.TracingEndpoint == "" {
+		return nil, fmt.Errorf("TracingEndpoint is required")
+	}
+	if config.TracingSampleRate < 0 || config.TracingSampleRate > 1 {
+		return nil, fmt.Errorf("TracingSampleRate must be between 0 and 1")
+	}
+	var propagation []string
+	for _, p := range strings.Split(config.TracingPropagation, ",") {
+		switch p = strings.TrimSpace(p); p {
+		case "":
+		case propagationW3C, propagationB3:
+			propagation = append(propagation, p)
+		default:
+			return nil, fmt.Errorf("unknown trace propagation %s", p)
+		}
+	}
+	return &Tracer{
+		Exporter:    config.TracingExporter,
+		Endpoint:    config.TracingEndpoint,
+		ServiceName: config.TracingServiceName,
+		SampleRate:  config.TracingSampleRate,
+		Propagation: propagation,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *Span, 4*spanBatchSize),
+		stopChan:    make(chan struct{}),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// Start exports the finished spans every few seconds or when a batch is full
+func (t *Tracer) Start() {
+	defer close(t.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, spanBatchSize)
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stopChan:
+			// export the spans finished before shutdown
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			t.export(batch)
+			return
+		}
+		t.export(batch)
+		batch = batch[:0]
+	}
+}
+
+// Stop flushes the pending spans
+func (t *Tracer) Stop() {
+	close(t.stopChan)
+	select {
+	case <-t.done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// StartServer starts the proxy span from the trace context of the caller,
+// or a new trace sampled at SampleRate
+func (t *Tracer) StartServer(req *http.Request) (*http.Request, *Span) {
+	if t == nil {
+		return req, nil
+	}
+	traceID, parentID, sampled, ok := extractTraceContext(req.Header)
+	if !ok {
+		traceID = newTraceID(16)
+		sampled = mathrand.Float64() < t.SampleRate
+	}
+	span := &Span{
+		TraceID:  traceID,
+		SpanID:   newTraceID(8),
+		ParentID: parentID,
+		Name:     req.Method,
+		Kind:     spanKindServer,
+		Start:    time.Now(),
+		Sampled:  sampled,
+		Attributes: map[string]string{
+			"http.method": req.Method,
+			"http.target": req.URL.RequestURI(),
+			"http.host":   req.Host,
+			"request.id":  requestIDFrom(req.Context()),
+		},
+		tracer: t,
+	}
+	return req.WithContext(context.WithValue(req.Context(), spanKey, span)), span
+}
+
+// startClientSpan starts an upstream attempt span, child of the proxy span,
+// and injects its trace context in the upstream request
+func startClientSpan(req *http.Request, service string) *Span {
+	parent, ok := req.Context().Value(spanKey).(*Span)
+	if !ok || parent == nil {
+		return nil
+	}
+	span := &Span{
+		TraceID:  parent.TraceID,
+		SpanID:   newTraceID(8),
+		ParentID: parent.SpanID,
+		Name:     req.Method + " " + service,
+		Kind:     spanKindClient,
+		Start:    time.Now(),
+		Sampled:  parent.Sampled,
+		Attributes: map[string]string{
+			"goc.service":   service,
+			"http.method":   req.Method,
+			"http.url":      req.URL.String(),
+			"net.peer.name": req.URL.Host,
+		},
+		tracer: parent.tracer,
+	}
+	span.inject(req.Header)
+	return span
+}
+
+// SetService names the span after the routed service
+func (s *Span) SetService(service string) {
+	if s == nil {
+		return
+	}
+	s.Name = s.Attributes["http.method"] + " " + service
+	s.Attributes["goc.service"] = service
+}
+
+// Finish records the status and queues the span for export when sampled
+func (s *Span) Finish(status int, err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.Status = status
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if !s.Sampled {
+		return
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+		log.Debugf("Tracing queue full, span %s dropped", s.SpanID)
+	}
+}
+
+// b3Headers are the B3 single and multi propagation headers
+var b3Headers = []string{"B3", "X-B3-TraceId", "X-B3-SpanId", "X-B3-ParentSpanId", "X-B3-Sampled", "X-B3-Flags"}
+
+// inject writes the span trace context in the configured formats and removes the caller
+// trace context of the other formats so the upstream sees a single trace context
+func (s *Span) inject(h http.Header) {
+	propagated := make(map[string]bool)
+	for _, p := range s.tracer.Propagation {
+		propagated[p] = true
+	}
+	if len(propagated) > 0 && !propagated[propagationW3C] {
+		h.Del("Traceparent")
+		h.Del("Tracestate")
+	}
+	if len(propagated) > 0 && !propagated[propagationB3] {
+		for _, name := range b3Headers {
+			h.Del(name)
+		}
+	}
+	for _, p := range s.tracer.Propagation {
+		switch p {
+		case propagationW3C:
+			flags := "00"
+			if s.Sampled {
+				flags = "01"
+			}
+			h.Set("Traceparent", "00-"+s.TraceID+"-"+s.SpanID+"-"+flags)
+		case propagationB3:
+			sampled := "0"
+			if s.Sampled {
+				sampled = "1"
+			}
+			h.Del("B3")
+			h.Set("X-B3-TraceId", s.TraceID)
+			h.Set("X-B3-SpanId", s.SpanID)
+			h.Set("X-B3-ParentSpanId", s.ParentID)
+			h.Set("X-B3-Sampled", sampled)
+			h.Del("X-B3-Flags")
+		}
+	}
+}
+
+// extractTraceContext reads the caller trace context from the W3C traceparent header,
+// or else from the B3 single or multi headers
+func extractTraceContext(h http.Header) (traceID string, spanID string, sampled bool, ok bool) {
+	if v := h.Get("Traceparent"); v != "" {
+		parts := strings.Split(v, "-")
+		if len(parts) >= 4 && len(parts[0]) == 2 && parts[0] != "ff" && validTraceID(parts[1], 32) && validTraceID(parts[2], 16) && len(parts[3]) == 2 {
+			flags, err := hex.DecodeString(parts[3])
+			if err == nil {
+				return parts[1], parts[2], flags[0]&1 == 1, true
+			}
+		}
+	}
+	if v := h.Get("B3"); v != "" {
+		parts := strings.Split(v, "-")
+		if len(parts) >= 2 && validB3TraceID(parts[0]) && validTraceID(parts[1], 16) {
+			sampled := len(parts) < 3 || parts[2] == "1" || parts[2] == "d"
+			return padTraceID(parts[0]), parts[1], sampled, true
+		}
+	}
+	if traceID, spanID := h.Get("X-B3-TraceId"), h.Get("X-B3-SpanId"); validB3TraceID(traceID) && validTraceID(spanID, 16) {
+		sampled := h.Get("X-B3-Sampled")
+		return padTraceID(traceID), spanID, sampled == "" || sampled == "1" || sampled == "true" || h.Get("X-B3-Flags") == "1", true
+	}
+	return "", "", false, false
+}
+
+// validTraceID checks a lower hex ID of the given length that is not all zeros
+func validTraceID(id string, length int) bool {
+	if len(id) != length || strings.Trim(id, "0") == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func validB3TraceID(id string) bool {
+	return validTraceID(id, 32) || validTraceID(id, 16)
+}
+
+// padTraceID widens 64 bit B3 trace IDs to 128 bit
+func padTraceID(id string) string {
+	if len(id) == 16 {
+		return strings.Repeat("0", 16) + id
+	}
+	return id
+}
+
+func newTraceID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// export sends a batch of spans to the collector
+func (t *Tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	var payload interface{}
+	if t.Exporter == exporterZipkin {
+		payload = t.zipkinSpans(batch)
+	} else {
+		payload = t.otlpSpans(batch)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("Tracing export error %s", err.Error())
+		return
+	}
+	resp, err := t.client.Post(t.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("Tracing export to %s error %s, %v spans dropped", t.Endpoint, err.Error(), len(batch))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warnf("Tracing export to %s failed with status %v, %v spans dropped", t.Endpoint, resp.StatusCode, len(batch))
+	}
+}
+
+// object is a JSON object of the export payloads
+type object = map[string]interface{}
+
+// otlpSpans builds an OTLP/HTTP JSON ExportTraceServiceRequest
+func (t *Tracer) otlpSpans(batch []*Span) interface{} {
+	attribute := func(key string, value interface{}) object {
+		if i, ok := value.(int); ok {
+			return object{"key": key, "value": object{"intValue": strconv.Itoa(i)}}
+		}
+		return object{"key": key, "value": object{"stringValue": value}}
+	}
+	spans := make([]object, 0, len(batch))
+	for _, s := range batch {
+		var attributes []object
+		if s.Status != 0 {
+			attributes = append(attributes, attribute("http.status_code", s.Status))
+		}
+		for k, v := range s.Attributes {
+			attributes = append(attributes, attribute(k, v))
+		}
+		kind, status := 2, object{}
+		if s.Kind == spanKindClient {
+			kind = 3
+		}
+		if s.Error != "" || s.Status >= 500 {
+			status = object{"code": 2, "message": s.Error}
+		}
+		span := object{
+			"traceId":           s.TraceID,
+			"spanId":            s.SpanID,
+			"name":              s.Name,
+			"kind":              kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        attributes,
+			"status":            status,
+		}
+		if s.ParentID != "" {
+			span["parentSpanId"] = s.ParentID
+		}
+		spans = append(spans, span)
+	}
+	return object{
+		"resourceSpans": []object{{
+			"resource": object{"attributes": []object{attribute("service.name", t.ServiceName)}},
+			"scopeSpans": []object{{
+				"scope": object{"name": "goc-proxy", "version": Version},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// zipkinSpans builds a Zipkin v2 JSON span list
+func (t *Tracer) zipkinSpans(batch []*Span) interface{} {
+	spans := make([]object, 0, len(batch))
+	for _, s := range batch {
+		tags := make(map[string]string, len(s.Attributes)+2)
+		if s.Status != 0 {
+			tags["http.status_code"] = strconv.Itoa(s.Status)
+		}
+		for k, v := range s.Attributes {
+			tags[k] = v
+		}
+		if s.Error != "" {
+			tags["error"] = s.Error
+		}
+		span := object{
+			"traceId":       s.TraceID,
+			"id":            s.SpanID,
+			"name":          s.Name,
+			"kind":          strings.ToUpper(s.Kind),
+			"timestamp":     s.Start.UnixNano() / int64(time.Microsecond),
+			"duration":      s.End.Sub(s.Start).Nanoseconds() / int64(time.Microsecond),
+			"localEndpoint": object{"serviceName": t.ServiceName},
+			"tags":          tags,
+		}
+		if s.ParentID != "" {
+			span["parentId"] = s.ParentID
+		}
+		if s.Kind == spanKindClient {
+			remote := object{"serviceName": s.Attributes["goc.service"]}
+			if host, port, err := net.SplitHostPort(s.Attributes["net.peer.name"]); err == nil {
+				if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+					remote["ipv4"] = host
+				} else if ip != nil {
+					remote["ipv6"] = host
+				}
+				if p, err := strconv.Atoi(port); err == nil {
+					remote["port"] = p
+				}
+			}
+			span["remoteEndpoint"] = remote
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSpanInjectPropagation(t *testing.T) {
+	tests := []struct {
+		name        string
+		propagation []string
+		incoming    map[string]string
+		present     []string
+		absent      []string
+	}{
+		{
+			name:        "b3 only strips traceparent",
+			propagation: []string{propagationB3},
+			incoming:    map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "Tracestate": "a=b"},
+			present:     []string{"X-B3-TraceId", "X-B3-SpanId", "X-B3-Sampled"},
+			absent:      []string{"Traceparent", "Tracestate"},
+		},
+		{
+			name:        "w3c only strips b3",
+			propagation: []string{propagationW3C},
+			incoming:    map[string]string{"B3": "4bf92f3577b34da6-00f067aa0ba902b7-1", "X-B3-TraceId": "4bf92f3577b34da6", "Tracestate": "a=b"},
+			present:     []string{"Traceparent", "Tracestate"},
+			absent:      []string{"B3", "X-B3-TraceId"},
+		},
+		{
+			name:        "both formats",
+			propagation: []string{propagationW3C, propagationB3},
+			incoming:    map[string]string{"B3": "4bf92f3577b34da6-00f067aa0ba902b7-1"},
+			present:     []string{"Traceparent", "X-B3-TraceId"},
+			absent:      []string{"B3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span := &Span{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Sampled: true,
+				tracer: &Tracer{Propagation: tt.propagation}}
+			h := http.Header{}
+			for k, v := range tt.incoming {
+				h.Set(k, v)
+			}
+			span.inject(h)
+			for _, name := range tt.present {
+				if h.Get(name) == "" {
+					t.Errorf("header %s is missing", name)
+				}
+			}
+			for _, name := range tt.absent {
+				if h.Get(name) != "" {
+					t.Errorf("header %s is forwarded: %s", name, h.Get(name))
+				}
+			}
+		})
+	}
+}
+
+// exportSpans records a proxy span and an upstream span and returns the body received by the collector
+func exportSpans(t *testing.T, exporter string) (body []byte, server *Span, client *Span) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		received <- data
+	}))
+	defer collector.Close()
+
+	tracer, err := NewTracer(&Config{
+		TracingExporter:    exporter,
+		TracingEndpoint:    collector.URL,
+		TracingServiceName: "goc-proxy",
+		TracingSampleRate:  1,
+		TracingPropagation: "w3c",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tracer.Start()
+
+	req, server := tracer.StartServer(httptest.NewRequest("GET", "http://proxy/echo/x", nil))
+	server.SetService("echo")
+	upstream, _ := http.NewRequest("GET", "http://10.0.0.1:8080/x", nil)
+	client = startClientSpan(upstream.WithContext(req.Context()), "echo")
+	client.Finish(200, nil)
+	server.Finish(200, nil)
+	tracer.Stop()
+
+	select {
+	case body = <-received:
+	default:
+		t.Fatal("no spans exported")
+	}
+	return body, server, client
+}
+
+func TestTracerExportOTLP(t *testing.T) {
+	body, server, client := exportSpans(t, exporterOTLP)
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Kind         int    `json:"kind"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%v spans exported, want 2", len(spans))
+	}
+	for _, s := range spans {
+		if s.TraceID != server.TraceID {
+			t.Errorf("span %s trace %s, want %s", s.SpanID, s.TraceID, server.TraceID)
+		}
+		if s.SpanID == client.SpanID && (s.ParentSpanID != server.SpanID || s.Kind != 3) {
+			t.Errorf("client span parent %s kind %v, want %s and 3", s.ParentSpanID, s.Kind, server.SpanID)
+		}
+	}
+}
+
+func TestTracerExportZipkin(t *testing.T) {
+	body, server, client := exportSpans(t, exporterZipkin)
+	var spans []struct {
+		TraceID        string            `json:"traceId"`
+		ID             string            `json:"id"`
+		ParentID       string            `json:"parentId"`
+		Kind           string            `json:"kind"`
+		Tags           map[string]string `json:"tags"`
+		RemoteEndpoint struct {
+			ServiceName string `json:"serviceName"`
+			IPv4        string `json:"ipv4"`
+			Port        int    `json:"port"`
+		} `json:"remoteEndpoint"`
+	}
+	if err := json.Unmarshal(body, &spans); err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("%v spans exported, want 2", len(spans))
+	}
+	for _, s := range spans {
+		if s.TraceID != server.TraceID {
+			t.Errorf("span %s trace %s, want %s", s.ID, s.TraceID, server.TraceID)
+		}
+		if s.ID != client.SpanID {
+			continue
+		}
+		if s.ParentID != server.SpanID || s.Kind != "CLIENT" || s.Tags["http.status_code"] != "200" {
+			t.Errorf("client span %+v", s)
+		}
+		if s.RemoteEndpoint.ServiceName != "echo" || s.RemoteEndpoint.IPv4 != "10.0.0.1" || s.RemoteEndpoint.Port != 8080 {
+			t.Errorf("client span remote endpoint %+v", s.RemoteEndpoint)
+		}
+	}
+}
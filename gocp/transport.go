@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// UpstreamSettings holds the connection settings of a service,
+// populated from the service Consul tags
+type UpstreamSettings struct {
+	Scheme             string
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+	Connect            bool
+	ProxyProtocol      string
+}
+
+// TransportPool holds a dedicated transport and reverse proxy for each upstream service
+// so TLS settings don't leak across services and connections are reused between requests
+type TransportPool struct {
+	Config     *Config
+	Connect    *ConnectAgent
+	Errors     *ErrorPages
+	Metrics    *RoundTripMetrics
+	transports map[string]*upstreamTransport
+	buffers    *bufferPool
+	mutex      sync.RWMutex
+}
+
+type upstreamTransport struct {
+	settings  UpstreamSettings
+	transport *http.Transport
+	proxy     *httputil.ReverseProxy
+}
+
+// bufferPool recycles the buffers used to copy response bodies
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} { return make([]byte, size) },
+		},
+	}
+}
+
+func (b *bufferPool) Get() []byte {
+	return b.pool.Get().([]byte)
+}
+
+func (b *bufferPool) Put(buf []byte) {
+	b.pool.Put(buf)
+}
+
+// NewTransportPool creates an empty transport pool
+func NewTransportPool(config *Config, connect *ConnectAgent, errors *ErrorPages, metrics *RoundTripMetrics) *TransportPool {
+	return &TransportPool{
+		Config:     config,
+		Connect:    connect,
+		Errors:     errors,
+		Metrics:    metrics,
+		transports: make(map[string]*upstreamTransport),
+		buffers:    newBufferPool(32 * 1024),
+	}
+}
+
+// Settings returns the upstream settings of a registry service,
+// they are parsed once per registry snapshot
+func (p *TransportPool) Settings(snapshot *RegistrySnapshot, service string) UpstreamSettings {
+	if settings, ok := snapshot.settings.Load(service); ok {
+		return settings.(UpstreamSettings)
+	}
+	settings := p.parseSettings(service, connectEndpoints(snapshot.Catalog[service], p.Connect != nil))
+	snapshot.settings.Store(service, settings)
+	return settings
+}
+
+// parseSettings parses the upstream settings from the service tags and meta,
+// the scheme defaults to Config.HttpScheme and an invalid scheme falls back to it.
+// Connect endpoints are always dialed with mTLS.
+func (p *TransportPool) parseSettings(service string, endpoints []Endpoint) UpstreamSettings {
+	tags := serviceTags(endpoints)
+	settings := UpstreamSettings{
+		Scheme: p.Config.HttpScheme,
+	}
+	if v, ok := tagValue(tags, tagProxyProtocol); ok {
+		settings.ProxyProtocol = v
+	}
+	if p.Connect != nil && len(endpoints) > 0 && endpoints[0].Connect {
+		settings.Scheme = "https"
+		settings.Connect = true
+		return settings
+	}
+	if v, ok := tagValue(tags, tagScheme); ok && v != "" {
+		settings.Scheme = v
+	}
+	// the service meta takes precedence over the tags
+	if v, ok := serviceMeta(endpoints, tagScheme); ok && v != "" {
+		settings.Scheme = v
+	}
+	switch scheme := strings.ToLower(strings.TrimSpace(settings.Scheme)); scheme {
+	case "http", "https":
+		settings.Scheme = scheme
+	default:
+		log.Warnf("Service %v scheme %q is invalid, using %v", service, settings.Scheme, p.Config.HttpScheme)
+		settings.Scheme = p.Config.HttpScheme
+	}
+	if v, ok := tagValue(tags, tagTLSCA); ok {
+		settings.CAFile = p.tlsPath(v)
+	}
+	if v, ok := tagValue(tags, tagTLSCert); ok {
+		settings.CertFile = p.tlsPath(v)
+	}
+	if v, ok := tagValue(tags, tagTLSKey); ok {
+		settings.KeyFile = p.tlsPath(v)
+	}
+	if v, ok := tagValue(tags, tagTLSServerName); ok {
+		settings.ServerName = v
+	}
+	if v, ok := tagValue(tags, tagTLSInsecure); ok && (v == "" || v == "true") {
+		settings.InsecureSkipVerify = true
+	}
+	return settings
+}
+
+// Get returns the service transport and proxy, they are rebuilt if the settings have changed
+func (p *TransportPool) Get(service string, settings UpstreamSettings) (*upstreamTransport, error) {
+	p.mutex.RLock()
+	t, ok := p.transports[service]
+	p.mutex.RUnlock()
+	if ok && t.settings == settings {
+		return t, nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if t, ok := p.transports[service]; ok && t.settings == settings {
+		return t, nil
+	}
+
+	transport, err := p.newTransport(service, settings)
+	if err != nil {
+		return nil, fmt.Errorf("service %s transport error %v", service, err)
+	}
+	if t, ok := p.transports[service]; ok {
+		t.transport.CloseIdleConnections()
+		log.Infof("Transport for service %v has been rebuilt, settings changed", service)
+	}
+	t = &upstreamTransport{
+		settings:  settings,
+		transport: transport,
+		proxy:     p.newProxy(service, settings.Scheme, transport),
+	}
+	p.transports[service] = t
+	return t, nil
+}
+
+// Prune closes the idle connections and removes the transports of inactive services
+func (p *TransportPool) Prune(active func(service string) bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for service, t := range p.transports {
+		if !active(service) {
+			t.transport.CloseIdleConnections()
+			delete(p.transports, service)
+			log.Infof("Transport for service %v has been removed", service)
+		}
+	}
+}
+
+// the endpoint is selected per request and passed through the request context
+func (p *TransportPool) newProxy(service string, scheme string, transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = scheme
+			req.URL.Host, _ = req.Context().Value(endpointKey).(string)
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		FlushInterval: 100 * time.Microsecond,
+		BufferPool:    p.buffers,
+		ModifyResponse: func(resp *http.Response) error {
+			// the response carries the proxy request ID
+			resp.Header.Del(p.Config.RequestIDHeader)
+			return rewriteResponse(resp)
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			p.Errors.UpstreamError(w, req, service, err)
+		},
+		Transport: &ProxyTransport{
+			Service:   service,
+			Transport: transport,
+			Metrics:   p.Metrics,
+		},
+	}
+}
+
+func (p *TransportPool) newTransport(service string, settings UpstreamSettings) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       time.Duration(p.Config.IdleConnTimeout) * time.Second,
+		MaxIdleConnsPerHost:   p.Config.MaxIdleConnsPerHost,
+		DisableKeepAlives:     p.Config.DisableKeepAlives,
+	}
+
+	// the PROXY protocol header describes a single client, connections can't be reused
+	switch settings.ProxyProtocol {
+	case "":
+	case "v1", "v2":
+		transport.DialContext = proxyProtoDialer(dialer, settings.ProxyProtocol)
+		transport.DisableKeepAlives = true
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %s", settings.ProxyProtocol)
+	}
+
+	if settings.Scheme != "https" {
+		return transport, nil
+	}
+
+	if settings.Connect {
+		transport.TLSClientConfig = p.Connect.TLSConfig(service)
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+	}
+	if settings.CAFile != "" {
+		pem, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// relative paths are resolved against Config.UpstreamTLSDir
+func (p *TransportPool) tlsPath(path string) string {
+	if path == "" || filepath.IsAbs(path) || p.Config.UpstreamTLSDir == "" {
+		return path
+	}
+	return filepath.Join(p.Config.UpstreamTLSDir, path)
+}